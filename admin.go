@@ -0,0 +1,176 @@
+//
+// An HTTP API for looking at and changing the yakker and notls tables,
+// for -admin. Since it can change how we treat clients, it only
+// answers requests from localhost.
+//
+//	GET /api/ipmaps/TABLE		all current entries
+//	GET /api/ipmaps/TABLE/IP	one entry
+//	DELETE /api/ipmaps/TABLE/IP	remove an entry
+//	PUT /api/ipmaps/TABLE/IP	add or replace an entry; takes
+//					optional ttl= and count= parameters
+//
+// TABLE is 'yakkers', 'yaknets' or 'notls'. yaknets is keyed by
+// network instead of IP, so its IP is a CIDR such as 192.0.2.0/24.
+// Entries are JSON objects with the IP, when it was last updated, its
+// count, and when it expires. A PUT entry by default lasts for as
+// long as the table's normal timeout and has a count that's high
+// enough to take effect.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ipEntry struct {
+	IP      string    `json:"ip"`
+	When    time.Time `json:"when"`
+	Count   int       `json:"count"`
+	Expires time.Time `json:"expires"`
+}
+
+// adminTable is an ipMap with its timeout and the count an entry
+// needs to have an effect.
+type adminTable struct {
+	m     *ipMap
+	ttl   time.Duration
+	count int
+	nets  bool
+}
+
+func adminTables() map[string]adminTable {
+	return map[string]adminTable{
+		"yakkers": {yakkers, yakTimeout, yakCount, false},
+		"yaknets": {yaknets, yakTimeout, yakCount, true},
+		"notls":   {notls, tlsTimeout, tlsFails, false},
+	}
+}
+
+// entries returns the current entries in i, sorted by IP.
+func (i *ipMap) entries(ttl time.Duration) []ipEntry {
+	i.Lock()
+	defer i.Unlock()
+	res := []ipEntry{}
+	for ip, t := range i.ips {
+		if time.Since(t.when) >= ttl {
+			continue
+		}
+		res = append(res, ipEntry{ip, t.when, t.count, t.when.Add(ttl)})
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].IP < res[b].IP })
+	return res
+}
+
+// put sets the entry for ip so that it has count and expires after
+// lifetime, given that entries in i normally last for ttl.
+func (i *ipMap) put(ip string, ttl, lifetime time.Duration, count int) ipEntry {
+	when := time.Now().Add(lifetime - ttl)
+	i.Lock()
+	i.insert(ip, &ipEnt{when: when, count: count})
+	i.stats.Sets++
+	i.Unlock()
+	return ipEntry{ip, when, count, when.Add(ttl)}
+}
+
+// fromLocalhost is true if r comes from a loopback address.
+func fromLocalhost(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !fromLocalhost(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/ipmaps/"), "/", 2)
+	tbl, ok := adminTables()[path[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(path) == 1 || path[1] == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, tbl.m.entries(tbl.ttl))
+		return
+	}
+
+	// Entries are keyed by the IP as we see it on connections,
+	// which is the canonical form, or by the canonical network.
+	var ip string
+	if tbl.nets {
+		if _, ipn, err := net.ParseCIDR(path[1]); err == nil {
+			ip = ipn.String()
+		}
+	} else if pip := net.ParseIP(path[1]); pip != nil {
+		ip = pip.String()
+	}
+	if ip == "" {
+		http.Error(w, "bad IP address", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		for _, e := range tbl.m.entries(tbl.ttl) {
+			if e.IP == ip {
+				writeJSON(w, e)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case "DELETE":
+		tbl.m.Del(ip)
+		warnf("admin: removed %s from %s\n", ip, path[0])
+		w.WriteHeader(http.StatusNoContent)
+	case "PUT":
+		lifetime, count := tbl.ttl, tbl.count
+		if count < 1 {
+			count = 1
+		}
+		if s := r.FormValue("ttl"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				http.Error(w, "bad ttl", http.StatusBadRequest)
+				return
+			}
+			lifetime = d
+		}
+		if s := r.FormValue("count"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "bad count", http.StatusBadRequest)
+				return
+			}
+			count = n
+		}
+		e := tbl.m.put(ip, tbl.ttl, lifetime, count)
+		warnf("admin: added %s to %s with count %d for %s\n", ip, path[0], count, lifetime)
+		writeJSON(w, e)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startAdmin starts the admin HTTP server on hostport.
+func startAdmin(hostport string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/ipmaps/", adminHandler)
+	go func() {
+		e := http.ListenAndServe(hostport, mux)
+		if e != nil {
+			die("admin HTTP server failed: %s\n", e)
+		}
+	}()
+}
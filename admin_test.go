@@ -0,0 +1,63 @@
+//
+// Test the admin API for the yakker and notls tables.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminDo(method, url, raddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	r.RemoteAddr = raddr
+	w := httptest.NewRecorder()
+	adminHandler(w, r)
+	return w
+}
+
+func TestAdminAPI(t *testing.T) {
+	defer func() { yakkers.ips = make(map[string]*ipEnt) }()
+	const lh = "127.0.0.1:40000"
+
+	if w := adminDo("GET", "/api/ipmaps/yakkers", "192.0.2.1:40000"); w.Code != http.StatusForbidden {
+		t.Errorf("remote request: got %d", w.Code)
+	}
+	if w := adminDo("PUT", "/api/ipmaps/yakkers/192.0.2.9?ttl=10m&count=7", lh); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d: %s", w.Code, w.Body)
+	}
+	hit, n := yakkers.Lookup("192.0.2.9", yakTimeout)
+	if !hit || n != 7 {
+		t.Errorf("PUT entry: got %v %d", hit, n)
+	}
+	if e := yakkers.entries(yakTimeout); len(e) != 1 || time.Until(e[0].Expires) > 10*time.Minute {
+		t.Errorf("PUT entry doesn't expire after its ttl: %+v", e)
+	}
+	if w := adminDo("GET", "/api/ipmaps/yakkers/192.0.2.9", lh); w.Code != http.StatusOK {
+		t.Errorf("GET: got %d", w.Code)
+	}
+	if w := adminDo("GET", "/api/ipmaps/yakkers/192.0.2.10", lh); w.Code != http.StatusNotFound {
+		t.Errorf("GET of missing entry: got %d", w.Code)
+	}
+	if w := adminDo("DELETE", "/api/ipmaps/yakkers/192.0.2.9", lh); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got %d", w.Code)
+	}
+	if hit, _ := yakkers.Lookup("192.0.2.9", yakTimeout); hit {
+		t.Errorf("DELETE didn't remove the entry")
+	}
+	defer func() { yaknets.ips = make(map[string]*ipEnt) }()
+	if w := adminDo("PUT", "/api/ipmaps/yaknets/192.0.2.9/24", lh); w.Code != http.StatusOK {
+		t.Errorf("PUT of network: got %d: %s", w.Code, w.Body)
+	}
+	if hit, _ := yaknets.Lookup("192.0.2.0/24", yakTimeout); !hit {
+		t.Errorf("PUT of network didn't add the canonical network")
+	}
+	for _, url := range []string{"/api/ipmaps/fred", "/api/ipmaps/yakkers/junk", "/api/ipmaps/notls/::1?ttl=-1h",
+		"/api/ipmaps/yakkers/192.0.2.0/24", "/api/ipmaps/yaknets/192.0.2.9"} {
+		if w := adminDo("PUT", url, lh); w.Code < 400 {
+			t.Errorf("PUT %s: got %d", url, w.Code)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 type perDest struct {
@@ -20,6 +21,8 @@ type perDest struct {
 	// parameters:
 	myname string
 	certs  []tls.Certificate
+
+	cmdtimeout, datatimeout, maxsession time.Duration
 }
 
 type destMap []*perDest
@@ -37,6 +40,11 @@ func (d *destMap) find(nc net.Conn) *perDest {
 		if de.local == "*" || de.local == las {
 			return de
 		}
+		// Unix domain sockets have no IP, and a nil IP is Equal
+		// to every other nil IP, including bad entries.
+		if ip == nil {
+			continue
+		}
 		if ip.Equal(net.ParseIP(de.local)) {
 			return de
 		}
@@ -51,6 +59,7 @@ func (d *destMap) find(nc net.Conn) *perDest {
 // Parse a file into a destMap
 // Format of the file is:
 //	ip-or-cidr	[hostname=<....>] [cert=<file> key=<file>]
+//			[cmdtimeout=<dur>] [datatimeout=<dur>] [maxsession=<dur>]
 
 func readConnFile(rdr *bufio.Reader) (*destMap, error) {
 	var d destMap
@@ -76,7 +85,7 @@ func readConnFile(rdr *bufio.Reader) (*destMap, error) {
 		// ls has at least one entry because we're skipping blank
 		// lines.
 		ls := strings.Fields(line)
-		if len(ls) > 4 {
+		if len(ls) > 7 {
 			return nil, fmt.Errorf("too many fields in line %d", lnum)
 		}
 		// TODO: should check that ls[0] is a valid local name.
@@ -95,6 +104,19 @@ func readConnFile(rdr *bufio.Reader) (*destMap, error) {
 				cert = kv[1]
 			case "key":
 				key = kv[1]
+			case "cmdtimeout", "datatimeout", "maxsession":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("bad %s duration '%s' in line %d", kv[0], kv[1], lnum)
+				}
+				switch kv[0] {
+				case "cmdtimeout":
+					pd.cmdtimeout = d
+				case "datatimeout":
+					pd.datatimeout = d
+				default:
+					pd.maxsession = d
+				}
 			default:
 				return nil, fmt.Errorf("unrecognized key '%s' in line %d", kv[0], lnum)
 			}
@@ -0,0 +1,78 @@
+//
+// Limits on concurrent connections, in total and from a single IP.
+//
+// Connections over either limit are told '421' and closed (or just
+// closed, with -limitdrop) before we do anything else with them,
+// including DNS lookups and smtpd setup.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var maxConns, maxPerIP int
+var limitDrop bool
+
+type connTable struct {
+	sync.Mutex
+	total int
+	ips   map[string]int
+	stats struct {
+		Active, Peak, IPs int
+	}
+}
+
+var conns = &connTable{ips: make(map[string]int)}
+
+// add counts a new connection from ip. If this connection is over
+// a limit it is not counted and add returns why.
+func (ct *connTable) add(ip string) string {
+	ct.Lock()
+	defer ct.Unlock()
+	switch {
+	case maxConns > 0 && ct.total >= maxConns:
+		events.connlimits.Add(1)
+		return "Too many connections"
+	case maxPerIP > 0 && ip != "" && ct.ips[ip] >= maxPerIP:
+		events.iplimits.Add(1)
+		return "Too many connections from your IP address"
+	}
+	ct.total++
+	ct.ips[ip]++
+	if ct.total > ct.stats.Peak {
+		ct.stats.Peak = ct.total
+	}
+	return ""
+}
+
+func (ct *connTable) done(ip string) {
+	ct.Lock()
+	ct.total--
+	ct.ips[ip]--
+	if ct.ips[ip] <= 0 {
+		delete(ct.ips, ip)
+	}
+	ct.Unlock()
+}
+
+// Stats is for expvar.Func().
+func (ct *connTable) Stats() interface{} {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.stats.Active = ct.total
+	ct.stats.IPs = len(ct.ips)
+	return ct.stats
+}
+
+// refuseConn tells an over-limit connection to go away. We don't
+// wait long for the client to take our 421.
+func refuseConn(nc net.Conn, why string) {
+	if limitDrop {
+		return
+	}
+	nc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	nc.Write([]byte("421 " + why + ", try again later\r\n"))
+}
@@ -4,10 +4,87 @@ away, or perhaps refuses things for you. It can log detailed transactions
 if desired. Messages are received in all 8 bits (and we do advertise
 8BITMIME, following the advice of http://cr.yp.to/smtp/8bitmime.html).
 
-usage: sinksmtp [options] [host]:port [[host]:port ...]
-
-Note that sinksmtp never exits. You must kill it by hand to shut
-it down.
+usage: sinksmtp [options] [proxy:][tls:][lmtp:]{[host]:port|unix:PATH} [...]
+
+sinksmtp runs until it gets a SIGTERM or SIGINT. It then stops
+accepting new connections and sends a 421 to every current session
+as soon as it's between commands; sessions that are in the middle of
+sending us a message get to finish it (and have it saved) first. Once
+all sessions have ended, or -stopwait has passed, it flushes its logs
+and exits. A second signal makes it exit immediately.
+
+On SIGUSR2 sinksmtp upgrades itself without dropping connections. It
+starts a new sinksmtp from its executable with the same arguments,
+passing it the listening sockets and the current do-nothing client
+(yakker), TLS failure, and greylisting state. Once the new process
+is running, the old one stops accepting connections and lets its
+current sessions finish on their own for up to -stopwait before
+shutting down as above. If the new process fails to start, the old
+one carries on.
+
+Under systemd, sinksmtp can be socket activated. Listening sockets
+passed in by systemd (through $LISTEN_FDS) are used in addition to
+any [host]:port arguments, which can then be omitted. This lets it
+listen on port 25 without being run as root. It also sends systemd
+service notifications: READY=1 once it's listening, STOPPING=1 when it
+starts shutting down, and WATCHDOG=1 pings if the unit has a
+WatchdogSec= setting. Use Type=notify in the unit file. If you upgrade
+with SIGUSR2, you also need NotifyAccess=all, since the new process
+tells systemd that it's now the main process.
+
+A listening address can have options in front of it, each followed
+by a ':'. These are:
+
+	proxy:	Connections come through a load balancer and start
+		with a HAProxy PROXY protocol header (version 1 or
+		2), eg 'proxy:[::]:25'. The remote and local
+		addresses in the header replace the connection's
+		own for everything, including rules, DNS lookups,
+		do-nothing client tracking, limits, and logs.
+		Connections must come from a -proxytrust address
+		and must send the header within ten seconds; other
+		connections, and ones with bad headers, are closed
+		without any reply and counted in the proxy_errors
+		expvar statistic. Headers without addresses (eg
+		from health checks) leave the connection's own
+		addresses alone.
+	tls:	Connections use TLS from the start instead of
+		STARTTLS, as on the SMTPS port, eg 'tls::465'. The
+		TLS certificates are chosen as for STARTTLS, from
+		-c and -k or -conncfg; connections without any are
+		closed. Failed handshakes are remembered like failed
+		STARTTLS setups (see 'TLS'), but since there's no
+		falling back to plain SMTP, TLS is always tried on
+		these listeners and 'tls-opt off' has no effect on
+		them. STARTTLS isn't offered.
+	lmtp:	Connections speak LMTP (RFC 2033) instead of SMTP,
+		so that sinksmtp can be a delivery target for
+		another mail server. Clients must say LHLO instead
+		of EHLO or HELO, and after a message's DATA they get
+		a reply for each accepted recipient. Rules, logging
+		and saving messages work just as for SMTP; rules see
+		LHLO as EHLO (and so does the SMTP log). However,
+		every recipient gets the same reply to the message:
+		@message rules are checked against each recipient,
+		but the first one that matches any recipient
+		decides for all of them, so a reject for one
+		recipient rejects the message for everyone.
+		STARTTLS isn't offered; use 'tls:lmtp:' for TLS.
+
+Options can be used together, eg 'proxy:tls:[host]:port'. Listeners
+passed in by systemd have no options.
+
+An address of 'unix:PATH' listens on a Unix domain socket instead of
+TCP, eg 'lmtp:unix:/run/sinksmtp/lmtp'. A leftover socket at PATH is
+removed first unless something is listening on it. The socket is
+created with the umask and owned by whoever started sinksmtp.
+Clients on Unix domain sockets have no IP address: their remote
+address is shown as '@', 'ip' and 'dnsbl' rules never match them,
+there's no reverse DNS, and they aren't subject to do-nothing client
+or TLS failure tracking, -maxperip, or rate limits. Unless you give
+-helo, the greeting uses the machine's hostname. PROXY headers are
+accepted from any client on a 'proxy:unix:' listener, without
+-proxytrust.
 
 Main options
 
@@ -34,6 +111,24 @@ This attempts to group options together logically.
 		If there are multiple certificates given, Go TLS will use
 		SNI to pick an appropriate one if possible.
 
+	-greydelay DUR, -greywindow DUR, -greylife DUR
+		For the 'greylist' rule action: how long a client
+		must wait before retrying (5m), how long after its
+		first attempt a retry is accepted (24h), and how long
+		a triplet that got through is remembered after it was
+		last seen (864h, 36 days). See Greylisting.
+	-greyprefix4 LEN, -greyprefix6 LEN
+		Greylisting treats clients in the same IPv4 or IPv6
+		network of this prefix length as one client, because
+		large senders retry from different IPs. The defaults
+		are 24 and 64; 32 and 128 greylist each IP address
+		separately.
+
+	-tlsfails NUM, -tlsdur DUR
+		Stop offering TLS to a client after NUM failures to set
+		up TLS within DUR. The defaults are 2 and 72h; see the
+		TLS section.
+
 	-conncfg FILE
 		This file can be used to specify the -helo and -c/-k
 		settings for new connections based on the local IP
@@ -48,6 +143,12 @@ This attempts to group options together logically.
 		Log SMTP commands received and server output (and some
 		additional info) to this file. May be '-' for stdout.
 
+	-sumlog FILE
+		Log a one-line JSON summary of every connection to this
+		file when the connection ends, whether or not it
+		delivered a message. May be '-' for stdout. See
+		'Session summaries' later.
+
 	-d DIR
 		Save received messages to this directory; received files
 		will be given probably-unique hash-based names. May be
@@ -56,6 +157,13 @@ This attempts to group options together logically.
 		hash-based name, we deliberately don't save over top of
 		it (and don't generate any errors). You probably want
 		-l too. The saved data includes message metadata.
+	-quarantine DIR
+		Save messages that match 'quarantine' rules to this
+		directory instead of the normal one. Their metadata
+		includes a 'quarantine' line with the reason, which
+		is the rule's note if it has one and otherwise the
+		rule. Rules files with quarantine rules are an error
+		without this.
 	-save-hash TYPE
 		Base the hash name on one of three things. See 'Save
 		file hash naming' later. Valid types are 'msg', 'full',
@@ -91,6 +199,26 @@ This attempts to group options together logically.
 		Both how long we stall a do-nothing client for before
 		giving it a second chance and the time window over which
 		we count do-nothing sessions.
+	-dnprefix4 LEN, -dnprefix6 LEN
+		Also count do-nothing sessions by the client's IPv4
+		or IPv6 network of this prefix length, for example
+		24 and 64. Once a network has -dncount of them from
+		any of its IPs, all of its clients are stalled. A
+		client that does something clears itself and takes
+		one off its network's count. 0, the default, turns
+		this off.
+		-dnlog lines about clients stalled or added because
+		of their network end with 'by net NETWORK'.
+	-dnaction ACTION
+		What do-nothing clients get. 'stall' (the default)
+		stalls them as described for -dncount; 'reject'
+		rejects their EHLO/HELO; 'drop' closes their
+		connection immediately; 'tarpit' stalls them and
+		sends them our output at one character a second.
+		Except with 'rules', their SMTP sessions aren't
+		logged. 'rules' treats them like anyone else, so
+		that rules can do what they want with them using
+		'yakker'.
 	-minphase PHASE
 		The minimum SMTP phase that a client must succeed at in
 		order to not be considered a do-nothing client. One of
@@ -108,6 +236,98 @@ This attempts to group options together logically.
 		statistics, reported at the standard endpoint
 		/debug/vars. The exposed statistics are unstable
 		and subject to change without notice.
+		Among them are latency histograms for each sort of
+		DNS lookup that sinksmtp does (rDNS, dnsbl and dbl,
+		domain validity, and so on) and for how long it took
+		to decide about each SMTP phase.
+		The -pprof server also serves a live stream of
+		events at /events; see 'Live events' later.
+	-web HOST:PORT
+		Run a web interface for browsing saved messages on
+		HOST:PORT. See 'Web interface' later. Like -pprof, you
+		should normally restrict this to localhost.
+	-webdirs DIR[,DIR2,...]
+		The directories of saved messages that -web shows.
+		Defaults to the -d directory.
+	-admin HOST:PORT
+		Run an HTTP API for the do-nothing client (yakker)
+		and TLS failure tables on HOST:PORT. It only answers
+		requests from localhost. See 'Admin API' later.
+	-index DIR
+		Keep a full-text index of saved messages in DIR. See
+		'Message index' later.
+	-search QUERY
+		Search the -index for QUERY, print the matching
+		messages, and exit.
+	-reindex DIR[,DIR2,...]
+		Rebuild the -index from scratch from these directories
+		of saved messages, then exit (after doing any -search).
+	-user USER, -group GROUP
+		Once sinksmtp has bound its listening sockets and opened
+		its log files and TLS certificate and key, switch to
+		running as USER and GROUP (by default, USER's primary
+		group). Startup fails if this doesn't work. USER cannot
+		be root.
+	-chroot DIR
+		With -user, chroot to DIR before switching users. All
+		other files that sinksmtp uses (the -d directory, rule
+		files and any files that they use, -conncfg, -index,
+		-statefile, -webdirs, and the convenience option
+		files) are then
+		inside DIR and must be given as paths in it, eg '-d
+		/msgs' for DIR/msgs. DIR also needs an etc/resolv.conf
+		for DNS lookups. You can't upgrade with SIGUSR2 when
+		chrooted, and after a SIGUSR2 upgrade without -chroot,
+		the new process opens its log files and certificates
+		as USER.
+	-proxytrust IP-OR-CIDR[,IP-OR-CIDR,...]
+		The addresses that are trusted to connect to proxy:
+		listeners and send PROXY headers, normally your load
+		balancers. Required if there are any proxy: listeners.
+	-maxconns N, -maxperip N
+		Limit how many connections we handle at once, in total
+		and from any single IP address. Connections over either
+		limit are sent a '421' and closed before anything else
+		is done with them; they are counted in the expvar
+		statistics. 0 (the default) means no limit.
+	-limitdrop
+		Close connections that are over -maxconns or -maxperip
+		without sending them a 421.
+	-cmdtimeout DURATION, -datatimeout DURATION
+		How long a client has to send us each command and
+		the DATA of each message, respectively, before we
+		close its connection. The default is the smtpd
+		package's default, currently two minutes and ten
+		minutes.
+	-maxsession DURATION
+		Close connections that last longer than this, even if
+		the client is still doing things. The default is no
+		limit.
+		Sessions closed because of any of these timeouts count
+		as aborts and get a '! timeout:' line in the SMTP log
+		that says which one it was.
+	-ipmapmax N
+		The most entries to keep in each of the do-nothing
+		client (yakker), TLS failure, and greylisting tables. When a table
+		is full, adding an entry evicts the least recently
+		used one; evictions are counted in the tables' expvar
+		statistics. The default is 100000; 0 means no limit.
+		Expired entries are removed every ten minutes
+		regardless.
+	-statefile FILE
+		Keep the do-nothing client (yakker), TLS failure, and
+		greylisting tables in FILE, so that they survive restarts. FILE
+		is loaded on startup (entries that have expired since
+		it was written are dropped) and rewritten every
+		-statesave and on shutdown. It's replaced atomically,
+		so its directory must be writable. After a SIGUSR2
+		upgrade only the new process writes it.
+	-statesave DURATION
+		How often to save the -statefile. The default is
+		five minutes.
+	-stopwait DURATION
+		How long to wait for sessions to finish when shutting
+		down or upgrading. The default is 30 seconds.
 	-statsperip
 		Keep additional expvar stats on a per-local-address
 		basis, so you can see which of multiple addresses
@@ -129,6 +349,15 @@ These are:
 	-heloreject FILE
 		Reject any EHLO/HELO name that matches something in in
 		this host list file.
+	-connrate N/DURATION, -netconnrate N/DURATION
+		Stall (at EHLO/HELO time) connections from IPs, or from
+		their /24 (for IPv4) or /64 (for IPv6), that have made
+		more than N connections in the last DURATION, eg
+		'-connrate 20/1m'. This is 'stall rate conn >N/DURATION'.
+	-msgrate N/DURATION, -netmsgrate N/DURATION
+		Stall MAIL FROMs from IPs, or from their networks, that
+		have sent us more than N messages in the last DURATION.
+		This is '@from stall rate msg >N/DURATION'.
 
 NOTE: the filenames here should not have funny characters in them
 such as whitespace or commas; otherwise you'll probably get internal
@@ -154,6 +383,12 @@ will only appear if the message was received over TLS. The cipher
 numbers are in octal because that is all net/tls gives us and I
 have not yet built a mapping. 'bodyhash ...' may not actually be
 a hash for sufficiently mangled messages.
+At the end of each session, the SMTP log gets a '! timing:' line
+that breaks down where the session's time went: the total, each
+sort of DNS lookup, and how long sinksmtp took to decide about each
+SMTP phase. 'connect' is the time until the greeting banner was ready
+and 'transfer' is the time the client took to send the message data.
+Things that happened more than once are followed by '/COUNT'.
 The ID that is printed in a number of places is composed of the
 the daemon's PID plus a sequence number of connections that this
 daemon has handled; this is to hopefully let you disentangle
@@ -167,6 +402,167 @@ DNS results that did not have a successful forward lookup;
 remote IP listed as one of their IPs. Some or all may be missing
 depending on DNS lookup results.
 
+Web interface
+
+With -web, sinksmtp serves a web interface and a JSON API for the
+saved messages in the -webdirs directories. When it starts it reads
+the metadata of every existing message in them (in the background),
+and it adds each new message as it's saved, including messages saved
+to other directories through 'savedir' rule options.
+
+	/			a list of messages, newest first, with a
+				search form
+	/msg/NAME		a message's metadata, headers, and MIME
+				parts (with the text of text parts)
+	/raw/NAME		the raw message source
+	/api/messages		the message list as JSON
+	/api/messages/NAME	a message's metadata, headers, and MIME
+				parts as JSON
+
+Since the same message can be saved in more than one directory, NAME
+takes a 'dir' query parameter (the 'dir' of the message in the JSON
+list); it defaults to the first -webdirs directory.
+
+Lists can be searched with the query parameters 'from' and 'to'
+(case-independent substrings of the MAIL FROM and any RCPT TO), 'ip'
+(the remote IP, an IP address or CIDR), 'hash' (a prefix of the file
+name, message hash, or body hash), 'since' and 'until' (dates as
+YYYY-MM-DD, both inclusive), and 'limit' (default 100).
+
+Message index
+
+With -index, sinksmtp adds every message it saves (in any directory)
+to an on-disk full-text index. The index records the metadata of each
+message plus its decoded Subject: and the text of its text parts. It
+is only ever appended to; -reindex throws it away and rebuilds it from
+existing save directories, which is also how you index messages saved
+before you started using -index. You can rebuild it while sinksmtp
+is running, but you then need to restart sinksmtp.
+
+A query is a list of terms, all of which must match. Plain words
+are matched case-independently against words in the subject and
+the text. Other terms match metadata:
+
+	from:ADDR from:@DOMAIN	the MAIL FROM ('from:<>' for null)
+	to:ADDR to:@DOMAIN	any RCPT TO
+	ip:IP			the remote IP
+	helo:NAME		the EHLO/HELO name
+	hash:HASH bodyhash:HASH	the message or body hash
+	name:NAME		the saved file name
+	date:YYYY-MM-DD		the day the message was received
+
+Queries can be made from the command line with -search, which prints
+the most recent matches first, or with -web at /api/search?q=QUERY,
+which returns JSON (with 'limit', default 100).
+
+Live events
+
+With -pprof, sinksmtp streams what is happening on all connections
+from the HTTP endpoint /events. Each event is a JSON object with the
+time, the type, our host name and PID, the connection ID, and the
+remote and local addresses, plus type specific fields. The types are
+'connect', 'command' (with 'cmd' and 'arg'), 'decision' (with the
+'phase', the 'action', and the responsible 'rule'), 'message' (with
+its 'hash', size in 'bytes', and transaction ID as 'arg'), and 'end'
+(with the furthest 'phase' reached and how the connection ended as
+'action').
+
+Events are sent as server-sent events by default; '?format=json'
+gives newline delimited JSON instead, eg for use with curl. The
+stream can be restricted with '?ip=IP|CIDR' to only connections from
+matching remote IPs and '?local=IP|CIDR|IP:PORT' to only connections
+to matching local addresses. Listeners that fall behind lose events.
+
+Greylisting
+
+A 'greylist' rule temporarily fails the first RCPT TO for each new
+triplet of client network, MAIL FROM, and RCPT TO, and then accepts
+retries of it that come at least -greydelay but no more than
+-greywindow after the first attempt. Once a triplet has got through
+it passes immediately until it goes unused for -greylife. A greylist
+rule doesn't decide anything for a triplet that has passed, so the
+RCPT TO goes on to the rest of the rules. Since
+greylisting needs the whole triplet, greylist rules are only checked
+at @to, as if they were written with '@to', and it's an error for one
+to have any other phase or to need @data or @message. You normally
+apply it selectively, for example:
+
+	greylist dns nodns
+	greylist not host .example.com
+
+Greylisting is tracked in memory (and saved with -statefile). Each
+greylisting decision is logged in the SMTP log, including for retries
+how many there have been and how long it's been since the first
+attempt, so you can see which senders retry. Clients that are
+greylisted don't count as do-nothing clients. Counts of greylisted
+RCPT TOs, retries, and triplets that passed are in the smtpcounts
+expvar statistics. The default temporary failure message can be
+changed with 'with message'.
+
+Admin API
+
+With -admin, the yakker and TLS failure (notls) tables can be looked
+at and changed over HTTP, for instance to forgive a legitimate client
+that was made a yakker. TABLE is 'yakkers', 'yaknets' or 'notls';
+for 'yaknets' (see -dnprefix4 and -dnprefix6) IP is a network such
+as 192.0.2.0/24:
+
+	GET /api/ipmaps/TABLE		list all current entries
+	GET /api/ipmaps/TABLE/IP	look up one IP address
+	DELETE /api/ipmaps/TABLE/IP	remove an IP address
+	PUT /api/ipmaps/TABLE/IP	add an IP address
+
+Entries are JSON objects with the 'ip', its 'count', and when it
+'expires'; 'when' is when it was last updated, as adjusted to make
+it expire at the right time. PUT takes optional 'ttl=DURATION' and
+'count=N' parameters. By default the new entry lasts as long as the
+table's normal timeout (-dndur for yakkers and yaknets, -tlsdur for
+notls) and has a count that makes it take effect (-dncount for them,
+-tlsfails for notls). Changes are logged to standard error. For example:
+
+	curl -X DELETE http://localhost:8025/api/ipmaps/yakkers/192.0.2.1
+	curl -X PUT 'http://localhost:8025/api/ipmaps/notls/192.0.2.1?ttl=1h'
+
+Session summaries
+
+With -sumlog, every connection produces one JSON object on a line of
+its own. The fields are:
+
+	id		the connection ID, as in other logs
+	start		when the connection started
+	duration	how long it lasted, in seconds
+	remote, local	the remote and local addresses
+	rdns		verified reverse DNS names for the remote IP
+	helo		the accepted EHLO/HELO name, if any
+	phase		the furthest SMTP phase successfully reached;
+			one of connect, helo, from, to, data, or message
+	action		the result of the last rules decision: accept,
+			reject, stall, greylist, drop, discard, or
+			quarantine
+	rule		the rule responsible for that result, if any
+	end		how the connection ended: quit, abort, dropped
+			(by a @connect reject, a drop rule, or
+			-dnaction drop), rset-drop (as a yakker after
+			an RSET), tls-failed (a failed TLS handshake
+			on a tls: listener), or shutdown
+	timeout		why an aborted session timed out, if it did
+	yakker		what happened with do-nothing client tracking:
+			stalled, rejected, dropped, tarpitted, or
+			flagged (depending on -dnaction), counted,
+			added, forced, cleared, or rset-drop
+	greylist	the last greylisting result: new, early (a
+			retry before -greydelay), passed, or known
+	tls		TLS details: whether it was on, the cipher,
+			protocol and SNI server name, how many TLS
+			errors there were, and whether TLS was not
+			offered because of past failures
+	commands	counts of EHLO, HELO, MAIL FROM, RCPT TO, and
+			DATA commands received
+	messages	how many messages were received and
+	message_bytes	their total size
+	bytes_in	bytes received and sent over the connection,
+	bytes_out	including any TLS overhead
+
 TLS
 
 To start with, an important note about TLS in sinksmtp. The Go people
@@ -178,9 +574,9 @@ you only use self-signed certificates with sinksmtp.
 
 Go only supports SSLv3+ and sinksmtp attempts to validate any client
 certificate that clients present to us. Both can cause TLS setup to
-fail. When TLS setup fails twice we remember the client IP and don't
-offer TLS to it if it reconnects within a certain amount of time
-(currently 72 hours).
+fail. When TLS setup fails twice (-tlsfails) we remember the client IP
+and don't offer TLS to it if it reconnects within a certain amount of
+time (72 hours by default; -tlsdur).
 
 Some TLS-capable clients always start out by trying the SSLv2 protocol
 (and then advertising TLS in it). SSLv2 uses a different handshake
@@ -223,17 +619,22 @@ argument allows you to specify a control file for this purpose.
 The format of the file is:
 
 	LOCAL	[hostname=HOSTNAME] [cert=CERTFILE key=KEYFILE]
+		[cmdtimeout=DURATION] [datatimeout=DURATION]
+		[maxsession=DURATION]
 
 (Lines may also be blank or start with '#' for a comment line.)
 
-LOCAL is either an IP address, an 'IP:PORT' value, a CIDR, or '*' to mean
-'matches everything'. It controls what incoming connections match this
-line. The hostname setting is the -helo setting used for the connection;
-cert= and key= set the files for the TLS certificate and key. Either or
+LOCAL is either an IP address, an 'IP:PORT' value, a CIDR, the path of
+a Unix domain socket, or '*' to mean 'matches everything'. It controls
+what incoming connections match this line. The hostname setting is the
+-helo setting used for the connection; cert= and key= set the files
+for the TLS certificate and key. Either or
 both are optional and the parameters can be in any order. The cert=
 and key= settings behave like the -c and -k command line arguments in
 that they can be given multiple certificates and keys, separated by
-commas (eg 'cert=c1.crt,c2.crt key=k1.key,k2,key').
+commas (eg 'cert=c1.crt,c2.crt key=k1.key,k2,key'). cmdtimeout=,
+datatimeout=, and maxsession= override the -cmdtimeout, -datatimeout,
+and -maxsession command line arguments for the connection.
 
 Lines are checked in order; the first matching line determines the
 settings for the connection. Thus you would normally stick any '*'
@@ -268,8 +669,18 @@ The simple general form of a rule is:
 	[PHASE] ACTION MATCH-OP [MATCH-OP....] ['with' WITH-OPTS]
 
 The action is one of 'accept', 'reject', 'stall' (which emits SMTP 4xx
-temporary failure messages), or 'set-with' (which simply sets with
-options). The optional phase says that the rule should only be checked
+temporary failure messages), 'greylist' (see the Greylisting section),
+'tarpit' (which sends this and all later replies on the connection at
+one character a second but, like 'set-with', doesn't decide anything
+by itself, so later rules are still checked), 'drop' (which closes the
+connection immediately without replying, or after a 421 reply if the
+rule has a 'with message'), 'discard' (which accepts a message but
+doesn't save it), 'quarantine' (which accepts a message and saves it
+in -quarantine), or 'set-with' (which simply sets with options). Drops
+are logged in the SMTP log along with the rule that caused them.
+Discard and quarantine rules are only checked at @message, as if they
+were written with '@message', and it's an error to give them any other
+phase. The optional phase says that the rule should only be checked
 and take effect in that phase of the SMTP transaction and is one of:
 
 	@connect @helo @from @to @data @message
@@ -283,7 +694,7 @@ known not to support it.
 
 (At the moment a 'stall' action at @connect time does nothing and a
 'reject' action causes the connection to be immediately dropped with
-no greeting banner.)
+no greeting banner, like 'drop'.)
 
 There is also a compact form for checking multiple rule clauses (with
 optional with clauses) at once. This separates rule clauses and their
@@ -487,6 +898,15 @@ described later.
 			more or less sure if a client is or isn't
 			going to do TLS until MAIL FROM time.
 
+ yakker			match if the remote IP or its network is a
+			do-nothing client (see -dncount). Unless
+			-dnaction is 'rules', such clients never get
+			to the rules.
+
+ tls-failed		match if the remote IP has failed TLS setup
+			often enough that we don't offer it TLS (see
+			-tlsfails and -tlsdur).
+
  from-has AATTRS, to-has AATTRS
 			The MAIL FROM or RCPT TO address has
 			at least one of the address attributes
@@ -500,6 +920,16 @@ described later.
 			one of these attributes; a comma separated
 			list.
 
+ rate RATE >N/DURATION	True if the remote IP (or its network) has
+			gone over N connections or messages in the
+			last DURATION, eg 'rate conn >10/1m'. RATE is
+			'conn' or 'msg' for the IP or 'netconn' or
+			'netmsg' for its /24 (IPv4) or /64 (IPv6).
+			The current connection counts; messages are
+			counted when they're received. DURATION is a
+			Go duration such as '30s', '10m', or '1h30m'.
+			N can be at most 9999.
+
 
 Address and hostname patterns
 
@@ -693,10 +1123,20 @@ the rule matches. The following options are supported:
 		or alter what happens in the rest of the session. It
 		only has any effect if -dncount is in effect.
 
+	delay DURATION
+		Wait for DURATION before replying when this rule
+		matches, for example '30s'. It can be at most five
+		minutes. With 'tarpit', this delays only the current
+		reply instead of slowing down everything after it.
+
 For example:
 
 	reject dnsbl sbl.spamhaus.org with message "You're SBL listed."
 	reject ehlo ylmf-pc with make-yakker
+	tarpit dnsbl zen.spamhaus.org
+	@to tarpit dns nodns with delay 20s
+	@message discard from @bulk.example.com
+	@message quarantine dnsbl sbl.spamhaus.org with note "SBL listed"
 
 For technical reasons, 'message' is ineffective for the replies to
 HELO and EHLO SMTP commands.
@@ -0,0 +1,198 @@
+//
+// A live stream of what's happening, served over HTTP on the -pprof
+// monitoring listener.
+//
+// Sessions publish events (new connections, SMTP commands, rule
+// decisions, received messages, and the end of connections) to a
+// broker, which fans them out to any HTTP clients that are listening
+// to /events. Clients get server-sent events by default or newline
+// delimited JSON with '?format=json', and can restrict what they see
+// with '?ip=IP|CIDR' (the remote IP) and '?local=IP|CIDR|IP:PORT'.
+//
+// Publishing is cheap when no one is listening, and a slow listener
+// has events dropped instead of slowing down SMTP sessions.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/siebenmann/smtpd"
+)
+
+type liveEvent struct {
+	Time   string `json:"time"`
+	Type   string `json:"type"`
+	Host   string `json:"host"`
+	ID     string `json:"id"`
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+	Cmd    string `json:"cmd,omitempty"`
+	Arg    string `json:"arg,omitempty"`
+	Phase  string `json:"phase,omitempty"`
+	Action string `json:"action,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+
+	// for filtering; not part of the output.
+	rip, lip string
+}
+
+type evtListener struct {
+	c     chan *liveEvent
+	ip    string // filter on remote IP or CIDR, if set
+	local string // filter on local IP, CIDR, or IP:port, if set
+}
+
+func (l *evtListener) wants(ev *liveEvent) bool {
+	if l.ip != "" && !matchIp(ev.rip, l.ip) {
+		return false
+	}
+	if l.local != "" && l.local != ev.Local && !matchIp(ev.lip, l.local) {
+		return false
+	}
+	return true
+}
+
+type evtBroker struct {
+	sync.Mutex
+	count     int32 // atomic, so that publishing can check cheaply
+	listeners map[*evtListener]bool
+}
+
+var liveEvents = &evtBroker{listeners: make(map[*evtListener]bool)}
+
+// our hostname, so that streams from several instances can be told
+// apart when merged.
+var evtHost = func() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s/%d", h, os.Getpid())
+}()
+
+func (b *evtBroker) subscribe(l *evtListener) {
+	b.Lock()
+	b.listeners[l] = true
+	atomic.AddInt32(&b.count, 1)
+	b.Unlock()
+}
+
+func (b *evtBroker) unsubscribe(l *evtListener) {
+	b.Lock()
+	delete(b.listeners, l)
+	atomic.AddInt32(&b.count, -1)
+	b.Unlock()
+}
+
+func (b *evtBroker) active() bool {
+	return atomic.LoadInt32(&b.count) > 0
+}
+
+func (b *evtBroker) publish(ev *liveEvent) {
+	b.Lock()
+	for l := range b.listeners {
+		if !l.wants(ev) {
+			continue
+		}
+		select {
+		case l.c <- ev:
+		default:
+			// this listener is not keeping up, so it loses
+			// the event.
+		}
+	}
+	b.Unlock()
+}
+
+// publishEvent fills in the common fields of an event from the
+// transaction and sends it off, if anyone is listening.
+func publishEvent(trans *smtpTransaction, ev *liveEvent) {
+	if !liveEvents.active() {
+		return
+	}
+	ev.Time = time.Now().Format(TimeNZ)
+	ev.Host = evtHost
+	ev.ID = trans.id
+	ev.Remote = trans.raddr.String()
+	ev.Local = trans.laddr.String()
+	ev.rip = trans.rip
+	ev.lip = trans.lip
+	liveEvents.publish(ev)
+}
+
+// cmdNames covers every smtpd.Command, so that command events always
+// say what the command was.
+var cmdNames = map[smtpd.Command]string{
+	smtpd.BadCmd: "bad command", smtpd.EHLO: "EHLO", smtpd.HELO: "HELO",
+	smtpd.MAILFROM: "MAIL FROM", smtpd.RCPTTO: "RCPT TO", smtpd.DATA: "DATA",
+	smtpd.QUIT: "QUIT", smtpd.RSET: "RSET", smtpd.NOOP: "NOOP",
+	smtpd.VRFY: "VRFY", smtpd.EXPN: "EXPN", smtpd.HELP: "HELP",
+	smtpd.AUTH: "AUTH", smtpd.STARTTLS: "STARTTLS",
+}
+
+// eventsHandler serves /events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	l := &evtListener{c: make(chan *liveEvent, 256),
+		ip: q.Get("ip"), local: q.Get("local")}
+	if l.ip != "" && !validIPArg(l.ip) {
+		http.Error(w, "bad ip filter", http.StatusBadRequest)
+		return
+	}
+	ndjson := q.Get("format") == "json"
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	liveEvents.subscribe(l)
+	defer liveEvents.unsubscribe(l)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-l.c:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if ndjson {
+				_, err = fmt.Fprintf(w, "%s\n", b)
+			} else {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// validIPArg is true if s is an IP address or a CIDR.
+func validIPArg(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
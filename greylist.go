@@ -0,0 +1,101 @@
+//
+// Greylisting, for the 'greylist' rule action.
+//
+// Greylisting tempfails the first RCPT TO for a new (client, MAIL FROM,
+// RCPT TO) triplet and then accepts retries of it that come after
+// -greydelay but within -greywindow of the first attempt. Once a
+// triplet has passed it's accepted straight away for -greylife after
+// it was last seen. The client is its network, per -greyprefix4 and
+// -greyprefix6, because big senders retry from different IPs.
+//
+// Pending and passed triplets are kept in two ipMaps, so they're
+// bounded by -ipmapmax and are saved with -statefile and passed on
+// in upgrades like the yakker and notls tables. Retries are logged,
+// so you can see which senders come back and how soon.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+var greypend = &ipMap{ips: make(map[string]*ipEnt)}
+var greypass = &ipMap{ips: make(map[string]*ipEnt)}
+
+// Theoretically redundant in the face of flag settings.
+var greyDelay = 5 * time.Minute
+var greyWindow = 24 * time.Hour
+var greyLife = 36 * 24 * time.Hour
+var greyPrefix4, greyPrefix6 = 24, 64
+
+// greyKey returns the greylisting key for a triplet. Saved state is
+// whitespace separated, so the addresses are escaped; the key starts
+// with the network so that it can be checked when it's loaded.
+func greyKey(rip, from, rcpt string) string {
+	return ipNet(rip, greyPrefix4, greyPrefix6) + "," +
+		url.QueryEscape(strings.ToLower(from)) + "," +
+		url.QueryEscape(strings.ToLower(rcpt))
+}
+
+// greyCheck checks key and records the attempt. It returns what
+// happened (new, early, passed, or known), how many attempts there
+// have been, and how long ago the first one was.
+func greyCheck(key string) (string, int, time.Duration) {
+	if hit, _ := greypass.Lookup(key, greyLife); hit {
+		greypass.Add(key, greyLife)
+		return "known", 0, 0
+	}
+	greypend.Lock()
+	defer greypend.Unlock()
+	greypend.stats.Adds++
+	t := greypend.ips[key]
+	if t == nil || time.Since(t.when) >= greyWindow {
+		// ipEnt.when is the first attempt for pending triplets,
+		// so they expire -greywindow after it.
+		greypend.insert(key, &ipEnt{when: time.Now(), count: 1})
+		greypend.stats.AddsNew++
+		return "new", 1, 0
+	}
+	t.count++
+	greypend.use(key, t)
+	age := time.Since(t.when)
+	if age < greyDelay {
+		return "early", t.count, age
+	}
+	greypend.remove(key)
+	greypass.Set(key, greyLife, t.count)
+	return "passed", t.count, age
+}
+
+// greylist applies greylisting to RCPT TO rcpt. It returns true if
+// the RCPT TO should be tempfailed.
+func greylist(trans *smtpTransaction, rcpt string) bool {
+	// Without an IP address there's nothing to key on.
+	if trans.rip == "" {
+		return false
+	}
+	what, cnt, age := greyCheck(greyKey(trans.rip, trans.from, rcpt))
+	trans.sess.greylist = what
+	switch what {
+	case "new":
+		events.greylisted.Add(1)
+		writeLog(trans.log,
+			"! greylisted %s: new triplet for <%s> -> <%s>\n",
+			trans.rip, trans.from, rcpt)
+	case "early":
+		events.greylisted.Add(1)
+		events.greyretries.Add(1)
+		writeLog(trans.log,
+			"! greylisted %s: retry %d too soon, %s after first attempt\n",
+			trans.rip, cnt-1, age.Round(time.Second))
+	case "passed":
+		events.greyretries.Add(1)
+		events.greypassed.Add(1)
+		writeLog(trans.log,
+			"! greylist passed %s: retry %d, %s after first attempt\n",
+			trans.rip, cnt-1, age.Round(time.Second))
+	}
+	return what == "new" || what == "early"
+}
@@ -0,0 +1,45 @@
+//
+// Test greylisting of triplets.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGreyCheck(t *testing.T) {
+	defer func() {
+		greypend.ips = make(map[string]*ipEnt)
+		greypass.ips = make(map[string]*ipEnt)
+	}()
+	k := greyKey("192.0.2.9", "A@Example.com", "joe@example.org")
+	if k2 := greyKey("192.0.2.200", "a@example.com", "JOE@example.org"); k2 != k {
+		t.Errorf("keys differ: '%s' vs '%s'", k, k2)
+	}
+	if k2 := greyKey("192.0.2.9", "", "joe example.org"); k2 != "192.0.2.0/24,,joe+example.org" {
+		t.Errorf("bad key for null sender: '%s'", k2)
+	}
+
+	if what, _, _ := greyCheck(k); what != "new" {
+		t.Errorf("first attempt: got %s", what)
+	}
+	if what, cnt, _ := greyCheck(k); what != "early" || cnt != 2 {
+		t.Errorf("immediate retry: got %s %d", what, cnt)
+	}
+	greypend.ips[k].when = time.Now().Add(-greyDelay)
+	if what, cnt, _ := greyCheck(k); what != "passed" || cnt != 3 {
+		t.Errorf("retry after the delay: got %s %d", what, cnt)
+	}
+	if what, _, _ := greyCheck(k); what != "known" {
+		t.Errorf("passed triplet: got %s", what)
+	}
+
+	// Retries after the window start over.
+	k = greyKey("192.0.2.9", "b@example.com", "joe@example.org")
+	greyCheck(k)
+	greypend.ips[k].when = time.Now().Add(-greyWindow)
+	if what, cnt, _ := greyCheck(k); what != "new" || cnt != 1 {
+		t.Errorf("retry after the window: got %s %d", what, cnt)
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Listening addresses and their options.
+//
+// A listening address on the command line can have options in front
+// of it, each followed by a ':', eg 'proxy:[::]:25'. Listeners that we
+// get from systemd have no options.
+//
+// An address of 'unix:PATH' is a Unix domain socket. Clients on these
+// have no IP address, so for them trans.rip and trans.lip are "" and
+// things that work on IP addresses (ip and dnsbl rules, reverse DNS,
+// do-nothing client and TLS failure tracking, per-IP limits and rate
+// limits) don't apply.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type listenOpts struct {
+	proxy bool // connections start with a PROXY protocol header
+	tls   bool // connections start with TLS, as on port 465
+	lmtp  bool // connections speak LMTP instead of SMTP
+	unix  bool // this is a Unix domain socket
+}
+
+func (lo *listenOpts) network() string {
+	if lo.unix {
+		return "unix"
+	}
+	return "tcp"
+}
+
+var listenPrefixes = map[string]func(*listenOpts){
+	"proxy": func(lo *listenOpts) { lo.proxy = true },
+	"tls":   func(lo *listenOpts) { lo.tls = true },
+	"lmtp":  func(lo *listenOpts) { lo.lmtp = true },
+}
+
+// parseListenArg splits any options off of a listening address. A
+// possible option is only taken as one if what's left is still a
+// host:port, so that eg 'proxy:25' listens on host 'proxy'.
+func parseListenArg(arg string) (string, *listenOpts, error) {
+	lo := &listenOpts{}
+	seen := make(map[string]bool)
+	for {
+		idx := strings.IndexByte(arg, ':')
+		if idx == -1 || !strings.Contains(arg[idx+1:], ":") {
+			break
+		}
+		set := listenPrefixes[arg[:idx]]
+		if set == nil {
+			break
+		}
+		if seen[arg[:idx]] {
+			return "", nil, fmt.Errorf("repeated option '%s' in listening address", arg[:idx])
+		}
+		seen[arg[:idx]] = true
+		set(lo)
+		arg = arg[idx+1:]
+	}
+	if strings.HasPrefix(arg, "unix:") {
+		lo.unix = true
+		arg = arg[len("unix:"):]
+		if arg == "" {
+			return "", nil, fmt.Errorf("empty path in 'unix:' listening address")
+		}
+	}
+	return arg, lo, nil
+}
+
+// listen opens a listening socket. A Unix domain socket left over
+// from a previous run is removed first, unless something is still
+// listening on it.
+func listen(addr string, lo *listenOpts) (net.Listener, error) {
+	if !lo.unix {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", addr); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket is in use")
+		}
+		os.Remove(addr)
+	}
+	return net.Listen("unix", addr)
+}
+
+// acceptedConn is a new connection and the options of the listener
+// it came in on.
+type acceptedConn struct {
+	nc net.Conn
+	lo *listenOpts
+}
+
+// tlsHandshake starts TLS on a connection from a tls: listener. The
+// client has wait to finish the handshake.
+func tlsHandshake(nc net.Conn, tlsc *tls.Config, wait time.Duration) (*tls.Conn, error) {
+	tc := tls.Server(nc, tlsc)
+	nc.SetDeadline(time.Now().Add(wait))
+	err := tc.Handshake()
+	nc.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
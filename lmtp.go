@@ -0,0 +1,134 @@
+//
+// LMTP (RFC 2033) on lmtp: listeners.
+//
+// The smtpd package only speaks SMTP, but LMTP differs from it in only
+// two ways that matter to us: clients say LHLO instead of EHLO (and
+// must not be allowed to say EHLO or HELO), and after a message's DATA
+// the server sends one reply for each accepted recipient instead of
+// one for the whole message. We handle both underneath smtpd, by
+// rewriting the commands that it reads and repeating its reply to the
+// message. We repeat whatever smtpd replies once the message has been
+// read, including replies that it makes itself, such as to messages
+// that are too big. Everything above that, including rules and saving
+// messages, is just as for SMTP. In particular a @message rule that
+// matches for any recipient decides for the message as a whole, so
+// all recipients get the same reply even though LMTP would let each
+// have its own.
+//
+// Because we sit between smtpd and the network, smtpd can't do
+// STARTTLS here; use a tls: listener for TLS.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+)
+
+type lmtpConn struct {
+	net.Conn
+	r       *bufio.Reader
+	pending []byte // the rest of the current line for Read
+	err     error  // an error to return once pending is read
+	midline bool   // the last line we read was incomplete
+	indata  bool   // we're reading a message's DATA
+	msgrcpt int    // how many recipients the current message has
+	rcpts   int    // how many times to send the reply to the message
+	reply   []byte // that reply, as we collect it
+}
+
+func newLMTPConn(nc net.Conn) *lmtpConn {
+	return &lmtpConn{Conn: nc, r: bufio.NewReader(nc)}
+}
+
+// cmdIs is true if line is the command cmd, possibly with arguments.
+func cmdIs(line []byte, cmd string) bool {
+	if len(line) < len(cmd) || !bytes.EqualFold(line[:len(cmd)], []byte(cmd)) {
+		return false
+	}
+	return len(line) == len(cmd) || strings.IndexByte(" \r\n", line[len(cmd)]) != -1
+}
+
+// translate rewrites a line from the client for smtpd. LHLO becomes
+// EHLO, while EHLO and HELO become something that smtpd will reject.
+// The message's DATA is left alone.
+func (lc *lmtpConn) translate(line []byte) {
+	start := !lc.midline
+	lc.midline = line[len(line)-1] != '\n'
+	switch {
+	case !start:
+	case lc.indata:
+		if s := string(line); s == ".\r\n" || s == ".\n" {
+			// Whatever smtpd says next is the reply to
+			// the message.
+			lc.indata = false
+			lc.rcpts = lc.msgrcpt
+		}
+	case cmdIs(line, "LHLO"):
+		copy(line, "EHLO")
+	case cmdIs(line, "EHLO"), cmdIs(line, "HELO"):
+		copy(line, "XHLO")
+	}
+}
+
+func (lc *lmtpConn) Read(b []byte) (int, error) {
+	if len(lc.pending) == 0 {
+		if lc.err != nil {
+			err := lc.err
+			lc.err = nil
+			return 0, err
+		}
+		line, err := lc.r.ReadSlice('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		if err != bufio.ErrBufferFull {
+			lc.err = err
+		}
+		lc.translate(line)
+		lc.pending = line
+	}
+	n := copy(b, lc.pending)
+	lc.pending = lc.pending[n:]
+	return n, nil
+}
+
+// replyDone is true if r ends with the last line of a reply, which
+// has a space after the reply code.
+func replyDone(r []byte) bool {
+	if len(r) < 2 || r[len(r)-1] != '\n' {
+		return false
+	}
+	last := r[bytes.LastIndexByte(r[:len(r)-1], '\n')+1:]
+	return len(last) >= 4 && last[3] == ' '
+}
+
+func (lc *lmtpConn) Write(b []byte) (int, error) {
+	if lc.rcpts == 0 {
+		// A 354 reply to DATA means that the message comes next.
+		for _, l := range bytes.SplitAfter(b, []byte("\n")) {
+			if bytes.HasPrefix(l, []byte("354")) {
+				lc.indata = true
+			}
+		}
+		return lc.Conn.Write(b)
+	}
+	lc.reply = append(lc.reply, b...)
+	if !replyDone(lc.reply) {
+		return len(b), nil
+	}
+	out := bytes.Repeat(lc.reply, lc.rcpts)
+	lc.reply, lc.rcpts = nil, 0
+	if _, err := lc.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// replyTo says that the message that's about to be sent has rcpts
+// recipients, so the reply to it must be sent that many times.
+func (lc *lmtpConn) replyTo(rcpts int) {
+	lc.msgrcpt = rcpts
+}
@@ -0,0 +1,100 @@
+//
+// Test the LMTP translation layer.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+type fakeConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (fc *fakeConn) Read(b []byte) (int, error)  { return fc.r.Read(b) }
+func (fc *fakeConn) Write(b []byte) (int, error) { return fc.w.Write(b) }
+
+func TestLMTPRead(t *testing.T) {
+	in := "LHLO client.example.com\r\nlhlo x\r\nEHLO x\r\nHELO x\r\nLHLOX\r\n" +
+		"DATA\r\nLHLO in the message\r\n.\r\nLHLO again\r\n"
+	fc := &fakeConn{r: strings.NewReader(in)}
+	lc := newLMTPConn(fc)
+	var out []byte
+	b := make([]byte, 7)
+	for {
+		n, err := lc.Read(b)
+		out = append(out, b[:n]...)
+		if strings.HasSuffix(string(out), "DATA\r\n") {
+			lc.Write([]byte("354 go ahead\r\n"))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+	}
+	exp := "EHLO client.example.com\r\nEHLO x\r\nXHLO x\r\nXHLO x\r\nLHLOX\r\n" +
+		"DATA\r\nLHLO in the message\r\n.\r\nEHLO again\r\n"
+	if string(out) != exp {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, exp)
+	}
+}
+
+// readAll reads everything from lc, as smtpd would.
+func readAll(lc *lmtpConn) {
+	b := make([]byte, 64)
+	for {
+		if _, err := lc.Read(b); err != nil {
+			return
+		}
+	}
+}
+
+func TestLMTPReplies(t *testing.T) {
+	fc := &fakeConn{r: strings.NewReader("a message\r\n.\r\n")}
+	lc := newLMTPConn(fc)
+	lc.Write([]byte("250 2.1.5 Okay\r\n"))
+	lc.replyTo(3)
+	lc.Write([]byte("354 go ahead\r\n"))
+	readAll(lc)
+	lc.Write([]byte("250-2.0.0 Accepted\r\n"))
+	lc.Write([]byte("250 2.0.0 "))
+	if fc.w.String() != "250 2.1.5 Okay\r\n354 go ahead\r\n" {
+		t.Fatalf("partial reply written: %q", fc.w.String())
+	}
+	lc.Write([]byte("Id 10\r\n"))
+	lc.Write([]byte("221 Bye\r\n"))
+	exp := "250 2.1.5 Okay\r\n354 go ahead\r\n" +
+		strings.Repeat("250-2.0.0 Accepted\r\n250 2.0.0 Id 10\r\n", 3) +
+		"221 Bye\r\n"
+	if out, _ := ioutil.ReadAll(&fc.w); string(out) != exp {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, exp)
+	}
+}
+
+// smtpd replies to messages that are too big itself, without telling
+// us about the message; every recipient must still get that reply.
+func TestLMTPOversize(t *testing.T) {
+	fc := &fakeConn{r: strings.NewReader(
+		strings.Repeat("a very big message\r\n", 1000) + ".\r\n")}
+	lc := newLMTPConn(fc)
+	lc.replyTo(3)
+	lc.Write([]byte("354 go ahead\r\n"))
+	readAll(lc)
+	fc.w.Reset()
+	lc.Write([]byte("552 5.3.4 Message too large\r\n"))
+	lc.Write([]byte("250 2.0.0 Okay\r\n"))
+	exp := strings.Repeat("552 5.3.4 Message too large\r\n", 3) +
+		"250 2.0.0 Okay\r\n"
+	if out, _ := ioutil.ReadAll(&fc.w); string(out) != exp {
+		t.Errorf("got:\n%s\nexpected:\n%s", out, exp)
+	}
+}
@@ -0,0 +1,477 @@
+//
+// An on-disk full-text index of saved messages.
+//
+// The index lives in its own directory and is append-only. 'docs' has
+// one JSON record per indexed message (its metadata plus the decoded
+// subject); a message's document ID is the offset of its record in
+// this file. The inverted index is spread over 256 posting files,
+// 'terms/00' through 'terms/ff', chosen by a hash of the term; each
+// line in them is 'TERM DOCID'. A search reads only the posting files
+// for its terms, intersects the document IDs, and then reads those
+// records from 'docs'.
+//
+// Terms are the lower-cased words of the subject and of the text parts
+// of the message, plus envelope and metadata terms of the form
+// 'from:ADDR', 'from:@DOMAIN', 'to:ADDR', 'to:@DOMAIN', 'ip:IP',
+// 'helo:NAME', 'hash:HASH', 'bodyhash:HASH', 'name:NAME', and
+// 'date:YYYY-MM-DD'. A query is a list of terms, all of which must
+// match.
+//
+// The index is added to by handleMessage() as it saves messages and
+// can be rebuilt from scratch from existing save directories.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+)
+
+// Words shorter or longer than this aren't indexed.
+const minWord, maxWord = 2, 40
+
+type ftIndex struct {
+	sync.Mutex
+	dir   string
+	docs  *os.File
+	size  int64 // last known size of docs
+	terms map[uint32]*os.File
+}
+
+// ftDoc is what we store in 'docs' for each message.
+type ftDoc struct {
+	*savedMsg
+	Subject string `json:"subject"`
+}
+
+// ftidx is nil unless -index is in use.
+var ftidx *ftIndex
+
+func openFTIndex(dir string) (*ftIndex, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "terms"), 0777); err != nil {
+		return nil, err
+	}
+	fp, err := os.OpenFile(filepath.Join(dir, "docs"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return &ftIndex{dir: dir, docs: fp, size: size,
+		terms: make(map[uint32]*os.File)}, nil
+}
+
+func (fi *ftIndex) Close() {
+	fi.Lock()
+	for _, fp := range fi.terms {
+		fp.Close()
+	}
+	fi.terms = make(map[uint32]*os.File)
+	fi.docs.Close()
+	fi.Unlock()
+}
+
+func termBucket(term string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(term))
+	return h.Sum32() % 256
+}
+
+func (fi *ftIndex) termFile(term string) string {
+	return filepath.Join(fi.dir, "terms", fmt.Sprintf("%02x", termBucket(term)))
+}
+
+// Posting files are opened on demand and then kept open. Called with
+// the lock held.
+func (fi *ftIndex) postings(b uint32) (*os.File, error) {
+	if fp := fi.terms[b]; fp != nil {
+		return fp, nil
+	}
+	fname := filepath.Join(fi.dir, "terms", fmt.Sprintf("%02x", b))
+	fp, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fi.terms[b] = fp
+	return fp, nil
+}
+
+// ----
+// Turning messages into terms.
+
+// words splits text into lower-cased words, adding them to the set.
+func words(text string, set map[string]bool) {
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) >= minWord && len(w) <= maxWord {
+			set[w] = true
+		}
+	}
+}
+
+// addrTerms adds 'what:ADDR' and 'what:@DOMAIN' for an address.
+func addrTerms(what, addr string, set map[string]bool) {
+	addr = strings.ToLower(addr)
+	if addr == "" {
+		set[what+":<>"] = true
+		return
+	}
+	set[what+":"+addr] = true
+	if idx := strings.LastIndexByte(addr, '@'); idx != -1 && idx < len(addr)-1 {
+		set[what+":"+addr[idx:]] = true
+	}
+}
+
+// stripTags crudely removes HTML tags so that we don't index tag
+// and attribute names.
+func stripTags(s string) string {
+	var b strings.Builder
+	intag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			intag = true
+		case r == '>' && intag:
+			intag = false
+			b.WriteByte(' ')
+		case !intag:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// msgText returns the decoded subject and the text of the text parts
+// of a raw message.
+func msgText(raw []byte) (string, string) {
+	var subject string
+	for _, h := range rawHeaders(raw) {
+		if strings.EqualFold(h.Name, "Subject") {
+			subject = h.Value
+			break
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return subject, ""
+	}
+	var texts []string
+	for _, p := range mimeParts(textproto.MIMEHeader(msg.Header), msg.Body, "", nil) {
+		switch p.ContentType {
+		case "text/html":
+			texts = append(texts, stripTags(p.Text))
+		default:
+			texts = append(texts, p.Text)
+		}
+	}
+	return subject, strings.Join(texts, "\n")
+}
+
+// docTerms generates all of the terms for a message.
+func docTerms(sm *savedMsg, subject, text string) []string {
+	set := make(map[string]bool)
+	words(subject, set)
+	words(text, set)
+	addrTerms("from", sm.From, set)
+	for _, t := range sm.To {
+		addrTerms("to", t, set)
+	}
+	meta := map[string]string{"ip": sm.Remote, "helo": strings.ToLower(sm.Helo),
+		"hash": sm.Hash, "bodyhash": sm.BodyHash, "name": sm.Name}
+	if !sm.When.IsZero() {
+		meta["date"] = sm.When.Format("2006-01-02")
+	}
+	for k, v := range meta {
+		if v != "" {
+			set[k+":"+v] = true
+		}
+	}
+	var terms []string
+	for t := range set {
+		// terms can't have whitespace in them because of the
+		// posting file format. Odd addresses and HELO names can.
+		if strings.IndexFunc(t, unicode.IsSpace) == -1 {
+			terms = append(terms, t)
+		}
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// add indexes a message, given its metadata and raw message.
+func (fi *ftIndex) add(sm *savedMsg, raw []byte) error {
+	subject, text := msgText(raw)
+	b, err := json.Marshal(&ftDoc{savedMsg: sm, Subject: subject})
+	if err != nil {
+		return err
+	}
+	terms := docTerms(sm, subject, text)
+
+	fi.Lock()
+	defer fi.Unlock()
+	// During an upgrade (see upgrade.go) two sinksmtp processes may
+	// be adding to the index at once, so we must lock it against
+	// other processes too and can't trust our idea of its size.
+	if err = syscall.Flock(int(fi.docs.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(fi.docs.Fd()), syscall.LOCK_UN)
+	st, err := fi.docs.Stat()
+	if err != nil {
+		return err
+	}
+	docid := st.Size()
+	if _, err = fi.docs.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	fi.size = docid + int64(len(b)+1)
+
+	// group the postings by file so that each file gets one write.
+	bufs := make(map[uint32]*bytes.Buffer)
+	for _, t := range terms {
+		bk := termBucket(t)
+		if bufs[bk] == nil {
+			bufs[bk] = &bytes.Buffer{}
+		}
+		fmt.Fprintf(bufs[bk], "%s %d\n", t, docid)
+	}
+	for bk, buf := range bufs {
+		fp, err := fi.postings(bk)
+		if err != nil {
+			return err
+		}
+		if _, err = fp.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ----
+// Searching.
+
+// queryTerms turns a query into index terms. Qualified terms
+// ('from:...' et al) are taken as they are, lower-cased; everything
+// else is split into words the same way that message text is.
+func queryTerms(query string) []string {
+	var terms []string
+	for _, f := range strings.Fields(query) {
+		if idx := strings.IndexByte(f, ':'); idx > 0 {
+			terms = append(terms, strings.ToLower(f))
+			continue
+		}
+		set := make(map[string]bool)
+		words(f, set)
+		for w := range set {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// lookup returns the set of document IDs for a term.
+func (fi *ftIndex) lookup(term string) (map[int64]bool, error) {
+	ids := make(map[int64]bool)
+	fp, err := os.Open(fi.termFile(term))
+	if os.IsNotExist(err) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	pref := term + " "
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, pref) {
+			continue
+		}
+		id, err := strconv.ParseInt(line[len(pref):], 10, 64)
+		if err == nil {
+			ids[id] = true
+		}
+	}
+	return ids, scanner.Err()
+}
+
+// readDoc reads the document record at a document ID.
+func (fi *ftIndex) readDoc(id int64) (*ftDoc, error) {
+	if st, err := fi.docs.Stat(); err == nil {
+		fi.size = st.Size()
+	}
+	rdr := bufio.NewReader(io.NewSectionReader(fi.docs, id, fi.size-id))
+	line, err := rdr.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	doc := &ftDoc{savedMsg: &savedMsg{}}
+	err = json.Unmarshal(line, doc)
+	return doc, err
+}
+
+// search returns up to limit documents that match all of the terms
+// in the query, most recently indexed first. Each message is only
+// returned once even if it was indexed several times.
+func (fi *ftIndex) search(query string, limit int) ([]*ftDoc, error) {
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	var ids map[int64]bool
+	for _, t := range terms {
+		tids, err := fi.lookup(t)
+		if err != nil {
+			return nil, err
+		}
+		if ids == nil {
+			ids = tids
+		} else {
+			for id := range ids {
+				if !tids[id] {
+					delete(ids, id)
+				}
+			}
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+	}
+	var sorted []int64
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+
+	fi.Lock()
+	defer fi.Unlock()
+	var res []*ftDoc
+	// The same name can be saved in several directories.
+	seen := make(map[msgKey]bool)
+	for _, id := range sorted {
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+		doc, err := fi.readDoc(id)
+		if err != nil {
+			return res, err
+		}
+		k := msgKey{doc.Dir, doc.Name}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		res = append(res, doc)
+	}
+	return res, nil
+}
+
+// rebuildFTIndex throws away any existing index in dir and creates a
+// new one from the messages in the save directories.
+func rebuildFTIndex(dir string, savedirs []string) (int, error) {
+	if err := os.RemoveAll(filepath.Join(dir, "terms")); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(filepath.Join(dir, "docs")); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	fi, err := openFTIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer fi.Close()
+	cnt := 0
+	for _, sd := range savedirs {
+		var aerr error
+		err = scanSaveDir(sd, func(sm *savedMsg) {
+			if aerr != nil {
+				return
+			}
+			_, raw, err := readSaved(sm.Dir, sm.Name)
+			if err != nil {
+				return
+			}
+			aerr = fi.add(sm, raw)
+			cnt++
+		})
+		if err == nil {
+			err = aerr
+		}
+		if err != nil {
+			return cnt, err
+		}
+	}
+	return cnt, nil
+}
+
+// ----
+// Using the index from the command line and over HTTP.
+
+// indexCommand handles -search and -reindex, which run instead of
+// listening for SMTP connections.
+func indexCommand(dir, query, savedirs string) {
+	if dir == "" {
+		die("-search and -reindex require -index\n")
+	}
+	if savedirs != "" {
+		cnt, err := rebuildFTIndex(dir, strings.Split(savedirs, ","))
+		if err != nil {
+			die("error rebuilding index in %s: %s\n", dir, err)
+		}
+		fmt.Printf("indexed %d messages\n", cnt)
+	}
+	if query == "" {
+		return
+	}
+	fi, err := openFTIndex(dir)
+	if err != nil {
+		die("error opening index %s: %s\n", dir, err)
+	}
+	defer fi.Close()
+	res, err := fi.search(query, 0)
+	if err != nil {
+		die("error searching: %s\n", err)
+	}
+	for _, d := range res {
+		fmt.Printf("%s %s <%s> -> <%s>: %s\n", d.When.Format(TimeNZ),
+			filepath.Join(d.Dir, d.Name), d.From,
+			strings.Join(d.To, ">, <"), d.Subject)
+	}
+}
+
+// apiSearchHandler serves /api/search?q=QUERY&limit=N on the -web
+// server.
+func apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	res, err := ftidx.search(r.FormValue("q"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if res == nil {
+		res = []*ftDoc{}
+	}
+	writeJSON(w, res)
+}
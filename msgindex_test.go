@@ -0,0 +1,99 @@
+//
+// Test the full-text message index.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var idxMsgs = []struct {
+	sm  savedMsg
+	raw string
+}{
+	{savedMsg{Name: "aaa", From: "Jim@Jones.com", To: []string{"joe@example.com"},
+		Remote: "192.168.10.3", When: time.Date(2017, 5, 21, 10, 0, 0, 0, time.Local)},
+		"Subject: =?utf-8?q?Cheap_Watches?=\n\nBuy our watches today.\n"},
+	{savedMsg{Name: "bbb", From: "", To: []string{"bob@example.com"},
+		Remote: "10.0.0.1"},
+		"Subject: bounce\nContent-Type: text/html\n\n<p class=\"watches\">Your message failed</p>\n"},
+}
+
+var idxSearches = []struct {
+	query string
+	names string
+}{
+	{"watches", "aaa"},
+	{"WATCHES today", "aaa"},
+	{"class", ""},
+	{"failed", "bbb"},
+	{"from:jim@jones.com", "aaa"},
+	{"from:<>", "bbb"},
+	{"to:@example.com", "bbb aaa"},
+	{"to:@example.com message", "bbb"},
+	{"ip:10.0.0.1", "bbb"},
+	{"date:2017-05-21 buy", "aaa"},
+	{"nosuchword", ""},
+}
+
+func TestFTIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinksmtp-idx")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fi, err := openFTIndex(dir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	for i := range idxMsgs {
+		if err := fi.add(&idxMsgs[i].sm, []byte(idxMsgs[i].raw)); err != nil {
+			t.Fatalf("add: %s", err)
+		}
+	}
+	// Check that a reopened index sees everything.
+	fi.Close()
+	fi, err = openFTIndex(dir)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	defer fi.Close()
+	for _, s := range idxSearches {
+		res, err := fi.search(s.query, 0)
+		if err != nil {
+			t.Errorf("search '%s': %s", s.query, err)
+			continue
+		}
+		names := ""
+		for _, d := range res {
+			if names != "" {
+				names += " "
+			}
+			names += d.Name
+		}
+		if names != s.names {
+			t.Errorf("search '%s': got '%s', expected '%s'", s.query, names, s.names)
+		}
+	}
+	res, _ := fi.search("watches", 0)
+	if len(res) > 0 && res[0].Subject != "Cheap Watches" {
+		t.Errorf("bad subject: '%s'", res[0].Subject)
+	}
+
+	// The same message saved in two directories is two results,
+	// but adding the same one again isn't.
+	sm := idxMsgs[0].sm
+	for _, d := range []string{"/save", "/quarantine", "/quarantine"} {
+		sm.Dir = d
+		if err := fi.add(&sm, []byte(idxMsgs[0].raw)); err != nil {
+			t.Fatalf("add: %s", err)
+		}
+	}
+	res, _ = fi.search("from:jim@jones.com", 0)
+	if len(res) != 3 {
+		t.Errorf("one name in two directories: got %d results, expected 3", len(res))
+	}
+}
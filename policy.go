@@ -0,0 +1,55 @@
+//
+// How we treat do-nothing clients (yakkers) and clients that keep
+// failing TLS.
+//
+// With -dnaction, yakkers can be stalled (the default), rejected,
+// dropped on connect, tarpitted (stalled with very slow output), or
+// left to the rules, which can match them with 'yakker'. -tlsfails and
+// -tlsdur set how many TLS failures in how long a time it takes before
+// we stop offering a client TLS; rules can match such clients with
+// 'tls-failed'.
+
+package main
+
+import (
+	"time"
+)
+
+// yakActions maps -dnaction values to what the session summary
+// reports for yakkers treated that way.
+var yakActions = map[string]string{
+	"stall":  "stalled",
+	"reject": "rejected",
+	"drop":   "dropped",
+	"tarpit": "tarpitted",
+	"rules":  "flagged",
+}
+
+var yakAction = "stall"
+
+// How slowly tarpitted yakkers and clients that match 'tarpit' rules
+// get our output, per character.
+const tarpitDelay = time.Second
+
+// The longest 'with delay' we allow. Clients generally give up on a
+// reply after five minutes.
+const maxDelay = 5 * time.Minute
+
+// Theoretically redundant in the face of flag settings.
+var tlsFails = 2
+var tlsTimeout = time.Hour * 72
+
+// Like stallall, but for -dnaction reject. A @connect reject drops
+// the connection, so this starts at EHLO/HELO.
+var rejectall []*Rule
+
+// yakRules returns the rules for yakkers, given the regular rules.
+func yakRules(rules []*Rule) []*Rule {
+	switch yakAction {
+	case "reject":
+		return rejectall
+	case "rules", "drop":
+		return rules
+	}
+	return stallall
+}
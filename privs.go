@@ -0,0 +1,103 @@
+//
+// Dropping privileges after we've bound our listening sockets.
+//
+// With -user (and optionally -group) we switch to that user and group
+// once our listening sockets are bound and our log files and TLS
+// certificates are opened. With -chroot we also chroot to a directory
+// first, after which all other files (the save directory, rule files,
+// and so on) are looked up inside it.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type privDrop struct {
+	uid, gid int
+	root     string
+}
+
+// chrooted is the directory we've chrooted to, if any.
+var chrooted string
+
+// lookupPrivs turns -user, -group, and -chroot into a privDrop. It
+// returns nil if there is nothing to do. The group defaults to the
+// user's primary group.
+func lookupPrivs(uname, gname, root string) (*privDrop, error) {
+	if uname == "" && gname == "" && root == "" {
+		return nil, nil
+	}
+	if uname == "" {
+		return nil, fmt.Errorf("-group and -chroot require -user")
+	}
+	pd := &privDrop{root: root}
+	u, err := user.Lookup(uname)
+	if err != nil {
+		u, err = user.LookupId(uname)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown user '%s'", uname)
+	}
+	pd.uid, _ = strconv.Atoi(u.Uid)
+	gid := u.Gid
+	if gname != "" {
+		g, err := user.LookupGroup(gname)
+		if err != nil {
+			g, err = user.LookupGroupId(gname)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown group '%s'", gname)
+		}
+		gid = g.Gid
+	}
+	pd.gid, _ = strconv.Atoi(gid)
+	if pd.uid == 0 {
+		return nil, fmt.Errorf("-user cannot be root")
+	}
+	return pd, nil
+}
+
+// drop chroots if asked to and then switches to our user and group.
+// It verifies that the switch has happened and can't be undone.
+func (pd *privDrop) drop() error {
+	// If we're the new process from an upgrade, our old process
+	// has already done all of this.
+	if os.Getuid() == pd.uid && os.Geteuid() == pd.uid && os.Getgid() == pd.gid {
+		return nil
+	}
+	if pd.root != "" {
+		// Things that are loaded on first use must be loaded
+		// before they disappear.
+		_ = time.Local.String()
+		if err := syscall.Chroot(pd.root); err != nil {
+			return fmt.Errorf("chroot to %s: %s", pd.root, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+		chrooted = pd.root
+	}
+	if err := syscall.Setgroups([]int{pd.gid}); err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	if err := syscall.Setgid(pd.gid); err != nil {
+		return fmt.Errorf("setgid %d: %s", pd.gid, err)
+	}
+	if err := syscall.Setuid(pd.uid); err != nil {
+		return fmt.Errorf("setuid %d: %s", pd.uid, err)
+	}
+
+	if os.Getuid() != pd.uid || os.Geteuid() != pd.uid || os.Getgid() != pd.gid || os.Getegid() != pd.gid {
+		return fmt.Errorf("privileges were not dropped: uid %d euid %d gid %d egid %d", os.Getuid(), os.Geteuid(), os.Getgid(), os.Getegid())
+	}
+	if syscall.Setuid(0) == nil {
+		return fmt.Errorf("could regain root privileges after dropping them")
+	}
+	return nil
+}
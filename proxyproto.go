@@ -0,0 +1,223 @@
+//
+// The HAProxy PROXY protocol, versions 1 and 2, for when we're behind
+// a TCP load balancer. See
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+//
+// Connections on 'proxy:' listeners must start with a PROXY header
+// from a -proxytrust source. We replace the connection's remote and
+// local addresses with the ones from the header before anything else
+// looks at them, so rules, DNS lookups, yakkers, limits and logs all
+// see the real client. Connections from anywhere else, and ones with
+// bad headers, are closed without a word. Clients on 'proxy:unix:'
+// listeners are always trusted.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the balancer has to send us the header.
+const proxyWait = 10 * time.Second
+
+// The longest valid v1 header, including the CR LF.
+const proxyV1Max = 107
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var proxyTrust []*net.IPNet
+
+// parseProxyTrust parses the -proxytrust list of IP addresses and
+// CIDRs.
+func parseProxyTrust(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("-proxytrust: bad IP address '%s'", e)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipn, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("-proxytrust: bad CIDR '%s'", e)
+		}
+		nets = append(nets, ipn)
+	}
+	return nets, nil
+}
+
+// proxyTrusted is true if addr can send us PROXY headers. Access to
+// Unix domain sockets is controlled by their permissions, so clients
+// on them are always trusted.
+func proxyTrusted(addr net.Addr) bool {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range proxyTrust {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection with the addresses from a PROXY header.
+type proxyConn struct {
+	net.Conn
+	raddr, laddr net.Addr
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr { return pc.raddr }
+func (pc *proxyConn) LocalAddr() net.Addr  { return pc.laddr }
+
+// readProxy reads the PROXY header from nc and returns a connection
+// with the client's addresses. Headers that don't have addresses
+// (v1 'UNKNOWN' and v2 'LOCAL', used for health checks) leave nc's
+// own.
+func readProxy(nc net.Conn) (net.Conn, error) {
+	if !proxyTrusted(nc.RemoteAddr()) {
+		return nil, fmt.Errorf("PROXY connection from untrusted source %s", nc.RemoteAddr())
+	}
+	nc.SetReadDeadline(time.Now().Add(proxyWait))
+	src, dst, err := parseProxyHeader(nc)
+	nc.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("bad PROXY header from %s: %s", nc.RemoteAddr(), err)
+	}
+	if src == nil {
+		return nc, nil
+	}
+	return &proxyConn{Conn: nc, raddr: src, laddr: dst}, nil
+}
+
+// parseProxyHeader reads a v1 or v2 PROXY header from r and returns
+// the source and destination addresses in it, or nils if it has none.
+// It reads exactly the header, so that r can go on to be used for
+// SMTP.
+func parseProxyHeader(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	start := make([]byte, 5)
+	if _, err = io.ReadFull(r, start); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case string(start) == "PROXY":
+		return parseProxyV1(r)
+	case bytes.Equal(start, proxyV2Sig[:5]):
+		return parseProxyV2(r)
+	}
+	return nil, nil, fmt.Errorf("no PROXY header")
+}
+
+// parseProxyV1 parses the rest of a v1 header after the 'PROXY'. It
+// reads a byte at a time so that it doesn't read past the end.
+func parseProxyV1(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	line := []byte("PROXY")
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1Max {
+			return nil, nil, fmt.Errorf("v1 header too long")
+		}
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("bad v1 header '%s'", line[:len(line)-2])
+	}
+	if src, err = proxyV1Addr(f[2], f[4], f[1] == "TCP4"); err != nil {
+		return nil, nil, err
+	}
+	if dst, err = proxyV1Addr(f[3], f[5], f[1] == "TCP4"); err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func proxyV1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 || strings.Contains(host, ":") == v4 {
+		return nil, fmt.Errorf("bad v1 address '%s'", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("bad v1 port '%s'", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseProxyV2 parses the rest of a v2 header after the first five
+// bytes of its signature.
+func parseProxyV2(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	hdr := make([]byte, 11)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:7], proxyV2Sig[5:]) {
+		return nil, nil, fmt.Errorf("bad v2 signature")
+	}
+	vercmd, fam := hdr[7], hdr[8]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[9:11]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if vercmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("bad v2 version %d", vercmd>>4)
+	}
+	switch vercmd & 0xf {
+	case 0: // LOCAL
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("bad v2 command %d", vercmd&0xf)
+	}
+
+	var alen int
+	switch fam {
+	case 0x11: // TCP over IPv4
+		alen = 4
+	case 0x21: // TCP over IPv6
+		alen = 16
+	default:
+		// We only handle TCP; anything else has no addresses
+		// that we can use, so we treat it like LOCAL.
+		return nil, nil, nil
+	}
+	if len(body) < 2*alen+4 {
+		return nil, nil, fmt.Errorf("v2 address block too short")
+	}
+	// Any TLVs after the addresses are ignored.
+	src = &net.TCPAddr{IP: net.IP(body[:alen]),
+		Port: int(binary.BigEndian.Uint16(body[2*alen:]))}
+	dst = &net.TCPAddr{IP: net.IP(body[alen : 2*alen]),
+		Port: int(binary.BigEndian.Uint16(body[2*alen+2:]))}
+	return src, dst, nil
+}
@@ -0,0 +1,98 @@
+//
+// Test PROXY protocol header parsing and listening address options.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func v2Header(cmd, fam byte, body []byte) []byte {
+	h := append([]byte{}, proxyV2Sig...)
+	h = append(h, 0x20|cmd, fam, byte(len(body)>>8), byte(len(body)))
+	return append(h, body...)
+}
+
+func TestProxyHeader(t *testing.T) {
+	v4body := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0, 25, 1, 0, 1, 'x'}
+	v6body := append(bytes.Repeat([]byte{0}, 15), 1)
+	v6body = append(v6body, bytes.Repeat([]byte{0}, 15)...)
+	v6body = append(v6body, 2, 0x04, 0x00, 0, 25)
+	for _, c := range []struct {
+		hdr      []byte
+		src, dst string
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 25\r\n"), "192.0.2.1:12345", "198.51.100.7:25"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1024 25\r\n"), "[2001:db8::1]:1024", "[2001:db8::2]:25"},
+		{[]byte("PROXY UNKNOWN\r\n"), "", ""},
+		{[]byte("PROXY UNKNOWN ffff:f::1 ffff:f::2 1 2\r\n"), "", ""},
+		{v2Header(1, 0x11, v4body), "192.0.2.1:12345", "198.51.100.7:25"},
+		{v2Header(1, 0x21, v6body), "[::1]:1024", "[::2]:25"},
+		{v2Header(0, 0x00, nil), "", ""},
+		{v2Header(1, 0x31, make([]byte, 216)), "", ""},
+	} {
+		// Anything after the header must be left unread.
+		r := bytes.NewReader(append(c.hdr, "EHLO"...))
+		src, dst, err := parseProxyHeader(r)
+		if err != nil {
+			t.Errorf("%q: error %s", c.hdr, err)
+			continue
+		}
+		if c.src == "" {
+			if src != nil || dst != nil {
+				t.Errorf("%q: got addresses %s %s", c.hdr, src, dst)
+			}
+		} else if src == nil || src.String() != c.src || dst.String() != c.dst {
+			t.Errorf("%q: got %s %s", c.hdr, src, dst)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "EHLO" {
+			t.Errorf("%q: left '%s' unread", c.hdr, rest)
+		}
+	}
+
+	for _, hdr := range [][]byte{
+		[]byte("EHLO fred\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345\r\n"),
+		[]byte("PROXY TCP4 2001:db8::1 198.51.100.7 12345 25\r\n"),
+		[]byte("PROXY TCP6 192.0.2.1 198.51.100.7 12345 25\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.7 012345 25\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.7 99999 25\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 25\n"),
+		append([]byte("PROXY "), bytes.Repeat([]byte("x"), 200)...),
+		v2Header(1, 0x11, v4body[:8]),
+		v2Header(2, 0x11, v4body),
+		v2Header(1, 0x11, v4body)[:20],
+		append([]byte{0x0d, 0x0a, 0x0d, 0x0a, 0, 'x'}, v2Header(1, 0x11, v4body)[6:]...),
+	} {
+		if _, _, err := parseProxyHeader(bytes.NewReader(hdr)); err == nil {
+			t.Errorf("%q: no error", hdr)
+		}
+	}
+}
+
+func TestParseListenArg(t *testing.T) {
+	for _, c := range []struct {
+		arg, addr   string
+		proxy, unix bool
+	}{
+		{":25", ":25", false, false},
+		{"proxy:25", "proxy:25", false, false},
+		{"proxy::25", ":25", true, false},
+		{"proxy:[::1]:25", "[::1]:25", true, false},
+		{"proxy:proxy:25", "proxy:25", true, false},
+		{"unix:/run/s", "/run/s", false, true},
+		{"proxy:unix:/run/s:1", "/run/s:1", true, true},
+	} {
+		addr, lo, err := parseListenArg(c.arg)
+		if err != nil || addr != c.addr || lo.proxy != c.proxy || lo.unix != c.unix {
+			t.Errorf("parseListenArg(%s): got '%s' %+v %v", c.arg, addr, lo, err)
+		}
+	}
+	for _, arg := range []string{"proxy:proxy::25", "unix:", "tls:unix:"} {
+		if _, _, err := parseListenArg(arg); err == nil {
+			t.Errorf("parseListenArg(%s): no error", arg)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//
+// The 'discard' and 'quarantine' rule actions.
+//
+// Both accept a message as far as the client can tell. A discarded
+// message isn't saved at all; a quarantined one is saved in the
+// -quarantine directory instead of the usual one, with a 'quarantine'
+// metadata line that gives the reason. Since these decide where the
+// message goes, the @message rules are checked for them before the
+// message is saved.
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var quarantineDir string
+
+var errNoQuarantine = errors.New("'quarantine' rules need a -quarantine directory")
+
+// usesQuarantine returns true if any of rules quarantines messages.
+func usesQuarantine(rules []*Rule) bool {
+	for _, r := range rules {
+		if r.result == aQuarantine {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantineReason is why a message was quarantined: the matching
+// rule's note if it has one, otherwise the rule itself.
+func quarantineReason(c *Context) string {
+	why := c.withprops["note"]
+	if why == "" && c.rule != nil {
+		why = c.rule.String()
+	}
+	// It goes on one metadata line.
+	return strings.Replace(why, "\n", " ", -1)
+}
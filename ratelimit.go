@@ -0,0 +1,210 @@
+//
+// Connection and message rate tracking, for 'rate' rules and the
+// -connrate et al options.
+//
+// For every remote IP and for the network it's in (its /24 for IPv4
+// and /64 for IPv6) we keep a log of when it connected to us and when
+// it sent us messages. Rates are counted over a sliding window by
+// looking at how many entries are recent enough. We keep entries for
+// as long as the longest window used by any rule we've seen.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The network prefix lengths used for 'netconn' and 'netmsg'.
+const rateNet4, rateNet6 = 24, 64
+
+// We never keep more entries than this for any one key, which means
+// that rate limits can't be larger than this.
+const maxRateEnts = 10000
+
+// What a rate is counting. The values are used as prefixes of keys
+// in the rate table.
+type rateKind byte
+
+const (
+	rConn    rateKind = 'c'
+	rMsg     rateKind = 'm'
+	rNetConn rateKind = 'C'
+	rNetMsg  rateKind = 'M'
+)
+
+var rateKinds = map[string]rateKind{
+	"conn": rConn, "msg": rMsg, "netconn": rNetConn, "netmsg": rNetMsg,
+}
+
+type rateTable struct {
+	sync.Mutex
+	ents   map[string][]time.Time
+	window time.Duration // how long we keep entries for
+	adds   int
+	stats  struct {
+		Size, Adds, Sweeps, Dropped int
+	}
+}
+
+var rates = &rateTable{ents: make(map[string][]time.Time), window: time.Hour}
+
+// ipNet returns the network that ip is in, as a CIDR string, using
+// prefix length p4 for IPv4 and p6 for IPv6. It returns "" if ip
+// isn't an IP address.
+func ipNet(ip string, p4, p6 int) string {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		return ""
+	}
+	var mask net.IPMask
+	if v4 := pip.To4(); v4 != nil {
+		pip = v4
+		mask = net.CIDRMask(p4, 32)
+	} else {
+		mask = net.CIDRMask(p6, 128)
+	}
+	n := &net.IPNet{IP: pip.Mask(mask), Mask: mask}
+	return n.String()
+}
+
+func rateKey(kind rateKind, ip string) string {
+	switch kind {
+	case rNetConn, rNetMsg:
+		ip = ipNet(ip, rateNet4, rateNet6)
+	}
+	if ip == "" {
+		return ""
+	}
+	return string(kind) + ip
+}
+
+// noteWindow makes sure that we keep entries for at least d.
+func (rt *rateTable) noteWindow(d time.Duration) {
+	rt.Lock()
+	if d > rt.window {
+		rt.window = d
+	}
+	rt.Unlock()
+}
+
+// trim drops entries that are older than our window. Called with the
+// lock held.
+func (rt *rateTable) trim(key string, now time.Time) []time.Time {
+	l := rt.ents[key]
+	i := 0
+	for i < len(l) && now.Sub(l[i]) >= rt.window {
+		i++
+	}
+	if i == len(l) {
+		delete(rt.ents, key)
+		return nil
+	}
+	if i > 0 {
+		l = l[i:]
+		rt.ents[key] = l
+	}
+	return l
+}
+
+// sweep trims every key. Called with the lock held.
+func (rt *rateTable) sweep(now time.Time) {
+	rt.stats.Sweeps++
+	for k := range rt.ents {
+		rt.trim(k, now)
+	}
+}
+
+// add records an event for ip, both for the IP and its network.
+func (rt *rateTable) add(kind rateKind, ip string) {
+	now := time.Now()
+	rt.Lock()
+	defer rt.Unlock()
+	netkind := rNetConn
+	if kind == rMsg {
+		netkind = rNetMsg
+	}
+	for _, k := range []string{rateKey(kind, ip), rateKey(netkind, ip)} {
+		if k == "" {
+			continue
+		}
+		l := rt.trim(k, now)
+		if len(l) >= maxRateEnts {
+			l = l[1:]
+			rt.stats.Dropped++
+		}
+		rt.ents[k] = append(l, now)
+	}
+	rt.stats.Adds++
+	rt.adds++
+	// Keys for IPs that we never hear from again would otherwise
+	// stay around forever.
+	if rt.adds%1000 == 0 {
+		rt.sweep(now)
+	}
+}
+
+// count returns how many events of kind there have been for ip in
+// the last window.
+func (rt *rateTable) count(kind rateKind, ip string, window time.Duration) int {
+	k := rateKey(kind, ip)
+	if k == "" {
+		return 0
+	}
+	now := time.Now()
+	rt.Lock()
+	defer rt.Unlock()
+	l := rt.trim(k, now)
+	cnt := 0
+	for i := len(l) - 1; i >= 0 && now.Sub(l[i]) < window; i-- {
+		cnt++
+	}
+	return cnt
+}
+
+// Stats is for expvar.Func().
+func (rt *rateTable) Stats() interface{} {
+	rt.Lock()
+	defer rt.Unlock()
+	rt.stats.Size = len(rt.ents)
+	return rt.stats
+}
+
+// rateLimit is a parsed 'N/DURATION' or '>N/DURATION'.
+type rateLimit struct {
+	kind   rateKind
+	count  int
+	window time.Duration
+	dstr   string // the duration as originally written
+}
+
+// parseRate parses 'N/DURATION', with an optional leading '>'.
+func parseRate(s string) (*rateLimit, error) {
+	s = strings.TrimPrefix(s, ">")
+	idx := strings.IndexByte(s, '/')
+	if idx == -1 {
+		return nil, fmt.Errorf("rate '%s' is not N/DURATION", s)
+	}
+	n, err := strconv.Atoi(s[:idx])
+	if err != nil || n < 0 || n >= maxRateEnts {
+		return nil, fmt.Errorf("bad count in rate '%s'", s)
+	}
+	d, err := time.ParseDuration(s[idx+1:])
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("bad duration in rate '%s'", s)
+	}
+	return &rateLimit{count: n, window: d, dstr: s[idx+1:]}, nil
+}
+
+// exceeded is true if ip is over the rate limit.
+func (rl *rateLimit) exceeded(ip string) bool {
+	return rates.count(rl.kind, ip, rl.window) > rl.count
+}
+
+func (rl *rateLimit) String() string {
+	return fmt.Sprintf(">%d/%s", rl.count, rl.dstr)
+}
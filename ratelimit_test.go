@@ -0,0 +1,67 @@
+//
+// Test rate tracking.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIPNet(t *testing.T) {
+	for _, c := range []struct{ ip, net string }{
+		{"192.168.10.3", "192.168.10.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"::ffff:10.1.2.3", "10.1.2.0/24"},
+		{"garbage", ""},
+	} {
+		if n := ipNet(c.ip, 24, 64); n != c.net {
+			t.Errorf("ipNet(%s): got '%s', expected '%s'", c.ip, n, c.net)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	good := map[string]string{"10/1m": ">10/1m", ">0/30s": ">0/30s", "5/1h30m": ">5/1h30m"}
+	for in, out := range good {
+		rl, err := parseRate(in)
+		if err != nil {
+			t.Errorf("parseRate(%s): %s", in, err)
+		} else if rl.String() != out {
+			t.Errorf("parseRate(%s): got '%s'", in, rl)
+		}
+	}
+	for _, in := range []string{"", "10", "10/", "x/1m", "-1/1m", "10/0s", "10/fred", "99999/1m"} {
+		if _, err := parseRate(in); err == nil {
+			t.Errorf("parseRate(%s): no error", in)
+		}
+	}
+}
+
+func TestRates(t *testing.T) {
+	rt := &rateTable{ents: make(map[string][]time.Time), window: time.Hour}
+	for i := 0; i < 3; i++ {
+		rt.add(rConn, "192.168.10.3")
+	}
+	rt.add(rConn, "192.168.10.4")
+	rt.add(rMsg, "192.168.10.4")
+	for _, c := range []struct {
+		kind rateKind
+		ip   string
+		cnt  int
+	}{
+		{rConn, "192.168.10.3", 3}, {rConn, "192.168.10.4", 1},
+		{rNetConn, "192.168.10.200", 4}, {rMsg, "192.168.10.3", 0},
+		{rNetMsg, "192.168.10.3", 1}, {rConn, "192.168.11.3", 0},
+	} {
+		if n := rt.count(c.kind, c.ip, time.Minute); n != c.cnt {
+			t.Errorf("%c %s: got %d, expected %d", c.kind, c.ip, n, c.cnt)
+		}
+	}
+	// Entries outside the window don't count and get trimmed.
+	k := rateKey(rConn, "192.168.10.3")
+	rt.ents[k][0] = time.Now().Add(-2 * time.Hour)
+	if n := rt.count(rConn, "192.168.10.3", 3*time.Hour); n != 2 {
+		t.Errorf("old entry not trimmed: count %d", n)
+	}
+}
@@ -93,6 +93,11 @@ const (
 	itemReject
 	itemStall
 	itemSetWith
+	itemGreylist
+	itemTarpit
+	itemDrop
+	itemDiscard
+	itemQuarantine
 
 	// expression bits
 	itemOr
@@ -113,6 +118,9 @@ const (
 	itemDnsbl
 	itemSource
 	itemDbl
+	itemRate
+	itemYakker
+	itemTlsFailed
 
 	// add-ons
 	itemWith
@@ -121,6 +129,7 @@ const (
 	itemSavedir
 	itemTlsOpt
 	itemMakeYakker
+	itemDelay
 
 	// options that do not duplicate keywords
 	itemEhlo
@@ -168,30 +177,38 @@ var keywords = map[string]itemType{
 	"@message": itemAMessage,
 
 	// actions
-	"accept":   itemAccept,
-	"reject":   itemReject,
-	"stall":    itemStall,
-	"set-with": itemSetWith,
+	"accept":     itemAccept,
+	"reject":     itemReject,
+	"stall":      itemStall,
+	"set-with":   itemSetWith,
+	"greylist":   itemGreylist,
+	"tarpit":     itemTarpit,
+	"drop":       itemDrop,
+	"discard":    itemDiscard,
+	"quarantine": itemQuarantine,
 
 	// ops
 	"or":  itemOr,
 	"not": itemNot,
 
 	// rule operations
-	"all":      itemAll,
-	"from":     itemFrom,
-	"to":       itemTo,
-	"helo":     itemHelo,
-	"host":     itemHost,
-	"from-has": itemFromHas,
-	"to-has":   itemToHas,
-	"helo-has": itemHeloHas,
-	"tls":      itemTls,
-	"dns":      itemDns,
-	"ip":       itemIp,
-	"dnsbl":    itemDnsbl,
-	"source":   itemSource,
-	"dbl":      itemDbl,
+	"all":        itemAll,
+	"from":       itemFrom,
+	"to":         itemTo,
+	"helo":       itemHelo,
+	"host":       itemHost,
+	"from-has":   itemFromHas,
+	"to-has":     itemToHas,
+	"helo-has":   itemHeloHas,
+	"tls":        itemTls,
+	"dns":        itemDns,
+	"ip":         itemIp,
+	"dnsbl":      itemDnsbl,
+	"source":     itemSource,
+	"dbl":        itemDbl,
+	"rate":       itemRate,
+	"yakker":     itemYakker,
+	"tls-failed": itemTlsFailed,
 
 	// add-ons
 	"with":        itemWith,
@@ -200,6 +217,7 @@ var keywords = map[string]itemType{
 	"savedir":     itemSavedir,
 	"tls-opt":     itemTlsOpt,
 	"make-yakker": itemMakeYakker,
+	"delay":       itemDelay,
 
 	// options
 	"ehlo":         itemEhlo,
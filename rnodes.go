@@ -43,13 +43,19 @@ const (
 	aError Action = iota
 	aNoresult
 	aAccept
+	aDiscard
+	aQuarantine
+	aTarpit
+	aGreylist
 	aStall
 	aReject
+	aDrop
 )
 
 var aMap = map[Action]string{
 	aError: "ERROR", aAccept: "accept", aReject: "reject", aStall: "stall",
-	aNoresult: "set-with",
+	aNoresult: "set-with", aGreylist: "greylist", aTarpit: "tarpit",
+	aDrop: "drop", aDiscard: "discard", aQuarantine: "quarantine",
 }
 
 func (a Action) String() string {
@@ -270,6 +276,28 @@ func (a *AllN) Eval(c *Context) (r Result) {
 	return true
 }
 
+// YakkerN is true if the remote IP or its network is currently a
+// do-nothing client. It is 'yakker'.
+type YakkerN struct{}
+
+func (y *YakkerN) String() string {
+	return "yakker"
+}
+func (y *YakkerN) Eval(c *Context) (r Result) {
+	return Result(c.trans.yakker)
+}
+
+// TlsFailedN is true if the remote IP has had enough TLS failures that
+// we don't offer it TLS. It is 'tls-failed'.
+type TlsFailedN struct{}
+
+func (t *TlsFailedN) String() string {
+	return "tls-failed"
+}
+func (t *TlsFailedN) Eval(c *Context) (r Result) {
+	return Result(c.trans.tlsfailed)
+}
+
 // TlsN is true if TLS is on. It is 'tls on|off'.
 type TlsN struct {
 	on bool
@@ -313,6 +341,21 @@ func (d *DNSblN) Eval(c *Context) (r Result) {
 	return res
 }
 
+// RateN is true if the remote IP (or its network) has gone over a
+// connection or message rate. It is 'rate conn|msg|netconn|netmsg
+// >N/DURATION'.
+type RateN struct {
+	what string
+	rl   *rateLimit
+}
+
+func (r *RateN) String() string {
+	return fmt.Sprintf("rate %s %s", r.what, r.rl)
+}
+func (r *RateN) Eval(c *Context) Result {
+	return Result(r.rl.exceeded(c.trans.rip))
+}
+
 // MatchN is a general matcher for from/to/helo/host. All of these have
 // a common pattern: they take an argument that may be a filename or a
 // pattern and they do either address or host matching of some data source
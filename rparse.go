@@ -25,6 +25,7 @@
 //            DNSBL DOMAIN
 //            SOURCE arg
 //            DBL DOM-SRC[,DOM-SRC] DOMAIN
+//            RATE CONN|MSG|NETCONN|NETMSG >N/DURATION
 // with    -> WITH clause
 // wclause -> wterm [wclause]
 // wterm   -> MESSAGE arg
@@ -45,6 +46,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
 // our approach to lookahead is that parsing rules must deliberately
@@ -224,6 +226,32 @@ func (p *parser) pDblArgs() (Option, string, error) {
 	return opt, arg, err
 }
 
+// parse rate arguments: CONN|MSG|NETCONN|NETMSG >N/DURATION
+// Neither is a keyword, so both are plain arguments that we check
+// ourselves.
+func (p *parser) pRateArgs() (*RateN, error) {
+	what, err := p.pArg()
+	if err != nil {
+		return nil, err
+	}
+	kind, ok := rateKinds[what]
+	if !ok {
+		return nil, p.posError(fmt.Sprintf("unknown rate '%s', expected conn, msg, netconn, or netmsg", what))
+	}
+	if p.curtok.typ != itemValue || p.curtok.val[0] != '>' {
+		return nil, p.genError("expected >N/DURATION")
+	}
+	rl, err := parseRate(p.curtok.val)
+	if err != nil {
+		return nil, p.posError(err.Error())
+	}
+	p.consume()
+	rl.kind = kind
+	// rates must keep enough history for us.
+	rates.noteWindow(rl.window)
+	return &RateN{what: what, rl: rl}, nil
+}
+
 // Minimum phase requirements for various things that cannot be evaluated
 // at any time.
 // This is used to set the overall phase requirement for the rule being
@@ -325,6 +353,7 @@ func (p *parser) pTerm() (expr Expr, err error) {
 	var arg string
 	var ison bool
 	var opts Option
+	var rate *RateN
 	switch ct {
 	case itemFrom, itemTo, itemHelo, itemEhlo, itemHost, itemSource:
 		p.consume()
@@ -342,12 +371,21 @@ func (p *parser) pTerm() (expr Expr, err error) {
 		// directly handle 'all' here since it has no argument.
 		p.consume()
 		return &AllN{}, nil
+	case itemYakker:
+		p.consume()
+		return &YakkerN{}, nil
+	case itemTlsFailed:
+		p.consume()
+		return &TlsFailedN{}, nil
 	case itemFromHas, itemToHas, itemDns, itemHeloHas:
 		p.consume()
 		opts, err = p.pCommaOpts(mapMap[ct])
 	case itemDbl:
 		p.consume()
 		opts, arg, err = p.pDblArgs()
+	case itemRate:
+		p.consume()
+		rate, err = p.pRateArgs()
 	default:
 		// The current token is not actually a valid term.
 		// Since we are bottoming out on the parsing stack,
@@ -386,6 +424,8 @@ func (p *parser) pTerm() (expr Expr, err error) {
 		return newHeloOpt(opts), nil
 	case itemTls:
 		return &TlsN{on: ison}, nil
+	case itemRate:
+		return rate, nil
 	case itemDbl:
 		// Set minimum phase requirement specially, based on the
 		// type of our lookup. We must check in this order so
@@ -506,6 +546,18 @@ func (p *parser) pWClause(rc *RClause) (bool, error) {
 			if arg != "off" && arg != "no-client" {
 				return gotone, p.posError(fmt.Sprintf("illegal tls-opt option '%s' in with clause", arg))
 			}
+		case itemDelay:
+			if rc.withs[cv] != "" {
+				return gotone, p.posError(fmt.Sprintf("repeated '%s' option in with clause", cv))
+			}
+			p.consume()
+			arg, err = p.pArg()
+			if err != nil {
+				break
+			}
+			if d, e := time.ParseDuration(arg); e != nil || d <= 0 || d > maxDelay {
+				return gotone, p.posError(fmt.Sprintf("illegal delay '%s' in with clause", arg))
+			}
 		case itemMakeYakker:
 			if _, ok := rc.withs[cv]; ok {
 				return gotone, p.posError(fmt.Sprintf("repeated '%s' option in with clause", cv))
@@ -610,7 +662,8 @@ func (p *parser) pRClause() error {
 // word start in here. As a result we ignore this possibility.
 var actions = map[itemType]Action{
 	itemAccept: aAccept, itemReject: aReject, itemStall: aStall,
-	itemSetWith: aNoresult,
+	itemSetWith: aNoresult, itemGreylist: aGreylist, itemTarpit: aTarpit,
+	itemDrop: aDrop, itemDiscard: aDiscard, itemQuarantine: aQuarantine,
 }
 
 func (p *parser) pRule() (r *Rule, err error) {
@@ -645,6 +698,23 @@ func (p *parser) pRule() (r *Rule, err error) {
 	if p.currule.deferto != pAny && p.currule.deferto < p.currule.requires {
 		return nil, p.lineError("rule specifies a phase lower than its operations require so we cannot satisfy the phase requirement")
 	}
+	// Greylisting happens at RCPT TO, so a greylist rule that can't
+	// be checked then would never do anything. Greylist rules are
+	// only checked then, so that they don't act as accepts in other
+	// phases and hide later rules.
+	if p.currule.result == aGreylist {
+		if p.currule.deferto != pAny && p.currule.deferto != pRto || p.currule.requires > pRto {
+			return nil, p.lineError("greylist rules must be checked at @to")
+		}
+		p.currule.deferto = pRto
+	}
+	// Similarly for discard and quarantine, which happen at @message.
+	if p.currule.result == aDiscard || p.currule.result == aQuarantine {
+		if p.currule.deferto != pAny && p.currule.deferto != pMessage {
+			return nil, p.lineError("discard and quarantine rules must be checked at @message")
+		}
+		p.currule.deferto = pMessage
+	}
 	p.consume()
 	return p.currule, err
 }
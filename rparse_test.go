@@ -403,6 +403,71 @@ func TestNotParse(t *testing.T) {
 	check("accept not\n accept all")
 }
 
+// Rules for client state, rate limits, and the newer actions and with
+// options. TestParse and TestSuccess stop at their first problem, so
+// these get their own test.
+var actParse = `
+stall rate conn >10/1m or rate netconn >100/1h
+@from stall rate msg >0/30s rate netmsg >5/1h30m
+reject yakker or tls-failed
+greylist dns nodns
+@to greylist not host .example.com
+tarpit dnsbl sbl.spamhaus.org
+@to tarpit all with delay 30s
+reject all with message "go away" delay 1m30s
+@message drop all
+drop dnsbl sbl.spamhaus.org with message "Go away"
+@message discard from @bulk.example.com
+quarantine dnsbl sbl.spamhaus.org with note "SBL listed"
+`
+
+var actNotParse = `@from greylist all
+@message greylist all
+@to discard all
+@connect quarantine all
+accept all with delay
+accept all with delay fred
+accept all with delay -1s
+accept all with delay 1h
+accept all with delay 1s delay 2s`
+
+func TestActions(t *testing.T) {
+	rules, err := Parse(actParse)
+	if err != nil {
+		t.Fatalf("Error reported: %s\n", err)
+	}
+	if len(rules) != 12 {
+		t.Fatalf("expected 12 rules, got %d", len(rules))
+	}
+	for i := range rules {
+		r1 := rules[i].String()
+		rls, err := Parse(r1)
+		if err != nil || len(rls) != 1 {
+			t.Errorf("round tripping: %s\nerr: %s\n", r1, err)
+			continue
+		}
+		if r2 := rls[0].String(); r2 != r1 {
+			t.Errorf("failed to round trip.\nstart:\t%s\nend:\t%s\n", r1, r2)
+		}
+	}
+
+	for _, ln := range strings.Split(actNotParse, "\n") {
+		if rules, err := Parse(ln); err == nil {
+			t.Errorf("rule did not error out: '%s'\n\t%+v\n", ln, rules)
+		}
+	}
+
+	// The standard context is neither a yakker nor has failed TLS.
+	c := setupContext(t)
+	rules, err = Parse("accept not yakker not tls-failed\n")
+	if err != nil {
+		t.Fatalf("error reported %s\n", err)
+	}
+	if !rules[0].check(c) {
+		t.Errorf("rule did not succeed: %v\n", rules[0])
+	}
+}
+
 // Test that we don't have a lexer goroutine sitting around after we're
 // done. This requires manual fiddling; we hand-construct the parser,
 // call p.pFile(), and then manually drain.
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/siebenmann/smtpd"
 )
@@ -44,6 +45,12 @@ type Context struct {
 	defresult   Action
 	defdnsblhit []string
 	defprops    map[string]string
+	defrule     *Rule
+
+	// the rule that determined the result of the last call to
+	// Decide(), if any. Like dnsblhit, this is out of band
+	// information for the caller.
+	rule *Rule
 
 	// A map of loaded files. Files are loaded as lists. An empty
 	// list means the file could not be loaded.
@@ -83,7 +90,9 @@ func (c *Context) getDnsblRes(hn string) Result {
 	if c.dnsbl[hn] != nil {
 		return *c.dnsbl[hn]
 	}
+	start := time.Now()
 	ips, err := net.LookupIP(hn)
+	noteDNS(c.trans, "dnsbl", start)
 	if err != nil {
 		// TODO: it's possible that we should set rulemiss here.
 		// Probably not, though.
@@ -115,7 +124,9 @@ func (c *Context) validDomain(domain string) DNSResult {
 	if c.domvalid[domain] != nil {
 		return *c.domvalid[domain]
 	}
+	start := time.Now()
 	t, err := ValidDomain(domain)
+	noteDNS(c.trans, "domain", start)
 	c.domvalid[domain] = &DNSResult{d: t, e: err}
 	return *c.domvalid[domain]
 }
@@ -375,6 +386,11 @@ func matchIp(rip string, cidr string) bool {
 	// (yes people do this sometimes). ParseIP() has the side effect
 	// of canonicalizing all of that for us.
 	ip := net.ParseIP(rip)
+	// Clients on Unix domain sockets have no IP, and a nil IP
+	// would be Equal to a bad cidr.
+	if ip == nil {
+		return false
+	}
 	ip2 := net.ParseIP(cidr)
 	if ip.Equal(ip2) {
 		return true
@@ -434,6 +450,7 @@ func Decide(ph Phase, evt smtpd.EventInfo, c *Context) Action {
 	}
 
 	var ret = aNoresult
+	c.rule = nil
 	c.dnsblhit = []string{}
 	c.withprops = make(map[string]string)
 	c.domerr = nil
@@ -454,6 +471,7 @@ func Decide(ph Phase, evt smtpd.EventInfo, c *Context) Action {
 	if c.defresult >= aAccept {
 		c.dnsblhit = c.defdnsblhit
 		c.withprops = c.defprops
+		c.rule = c.defrule
 		return c.defresult
 	}
 
@@ -509,8 +527,21 @@ func Decide(ph Phase, evt smtpd.EventInfo, c *Context) Action {
 		}
 		if res {
 			//fmt.Printf(" matched and: %v\n", ret)
+			// Tarpitting doesn't decide anything, it just
+			// slows the client down, so like set-with it's
+			// only a property and we carry on.
+			if r.result == aTarpit {
+				c.withprops["tarpit"] = tarpitDelay.String()
+				continue
+			}
+			// A triplet that has passed greylisting goes on
+			// to the rest of the rules.
+			if r.result == aGreylist && !greylist(c.trans, c.rcptto) {
+				continue
+			}
 			if r.result >= aAccept {
 				ret = r.result
+				c.rule = r
 				break
 			}
 		}
@@ -519,11 +550,14 @@ func Decide(ph Phase, evt smtpd.EventInfo, c *Context) Action {
 	}
 
 	// Do we need to defer our result in order to accept a
-	// MAIL FROM:<>?
-	if ph == pMfrom && c.from == "" && ret > aAccept {
+	// MAIL FROM:<>? Drops aren't deferred; a client that we want
+	// to drop doesn't get to send us bounces.
+	if ph == pMfrom && c.from == "" && ret > aAccept && ret != aDrop {
 		c.defresult = ret
 		c.defprops = c.withprops
 		c.defdnsblhit = c.dnsblhit
+		c.defrule = c.rule
+		c.rule = nil
 		c.withprops = make(map[string]string)
 		// we deliberately don't clear c.dnsblhit so that we log
 		// it as soon as possible, even if the connection is then
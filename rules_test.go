@@ -1,6 +1,6 @@
 //
-// Right now this merely tests some support functions in rules.go and
-// does not attempt to test the main Decide() function. That one is
+// Right now this mostly tests some support functions in rules.go and
+// only tests a little of the main Decide() function. That one is
 // complicated, especially if we want to test the full logic; we'd
 // have to construct some rules and then drive an entire conversation
 // through Decide().
@@ -9,8 +9,94 @@ package main
 
 import (
 	"testing"
+	"time"
+
+	"github.com/siebenmann/smtpd"
 )
 
+// Rules for actions that only happen in one phase must not win in
+// other phases and hide later rules.
+func TestDecidePhases(t *testing.T) {
+	rules, err := Parse("greylist all\nquarantine all\ndiscard all\nreject all\n")
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	defer func() { greypend.ips = make(map[string]*ipEnt) }()
+	c := newContext(&smtpTransaction{rip: "192.0.2.9", sess: newSessStats()}, rules)
+	for _, ph := range []Phase{pConnect, pHelo, pMfrom, pRto, pData, pMessage} {
+		want := aReject
+		switch ph {
+		case pRto:
+			want = aGreylist
+		case pMessage:
+			want = aQuarantine
+		}
+		if res := Decide(ph, smtpd.EventInfo{Arg: "a@b"}, c); res != want {
+			t.Errorf("%s: got %s, want %s", ph, res, want)
+		}
+	}
+}
+
+// Once a triplet has passed greylisting, the rules after the greylist
+// rule decide.
+func TestDecideGreylist(t *testing.T) {
+	defer func(d time.Duration) {
+		greyDelay = d
+		greypend.ips = make(map[string]*ipEnt)
+		greypass.ips = make(map[string]*ipEnt)
+	}(greyDelay)
+	greyDelay = 0
+	rules, err := Parse("greylist all\nreject to bad@example.com\n")
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	trans := &smtpTransaction{rip: "192.0.2.9", from: "a@b", sess: newSessStats()}
+	c := newContext(trans, rules)
+	for _, tc := range []struct {
+		arg  string
+		want Action
+	}{
+		{"bad@example.com", aGreylist},
+		{"bad@example.com", aReject},
+		{"good@example.com", aGreylist},
+		{"good@example.com", aNoresult},
+		{"bad@example.com", aReject},
+	} {
+		res := Decide(pRto, smtpd.EventInfo{Arg: tc.arg}, c)
+		if res != tc.want {
+			t.Errorf("%s (%s): got %s, want %s", tc.arg, trans.sess.greylist, res, tc.want)
+		}
+	}
+}
+
+// Tarpit rules don't decide anything, so the rules after them must
+// still fire.
+func TestDecideTarpit(t *testing.T) {
+	rules, err := Parse("tarpit all\n@message quarantine all\nreject to bad@example.com\n")
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	c := newContext(&smtpTransaction{}, rules)
+	for _, tc := range []struct {
+		ph   Phase
+		arg  string
+		want Action
+	}{
+		{pHelo, "example.com", aNoresult},
+		{pRto, "good@example.com", aNoresult},
+		{pRto, "bad@example.com", aReject},
+		{pMessage, "", aQuarantine},
+	} {
+		res := Decide(tc.ph, smtpd.EventInfo{Arg: tc.arg}, c)
+		if res != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.ph, tc.arg, res, tc.want)
+		}
+		if c.withprops["tarpit"] == "" {
+			t.Errorf("%s %s: tarpit not set", tc.ph, tc.arg)
+		}
+	}
+}
+
 //
 // Test address and host matches, since so much depends on them.
 var aMatches = []struct {
@@ -0,0 +1,210 @@
+//
+// Read back saved message files, as written by handleMessage() using
+// msgDetails(). Everything up to and including the 'body' line is our
+// metadata; the actual message follows.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// savedMsg is the metadata of a saved message. Name is the file's
+// name (ie its save hash) and Dir is the directory it's in.
+type savedMsg struct {
+	Name     string    `json:"name"`
+	Dir      string    `json:"dir"`
+	ID       string    `json:"id"`
+	When     time.Time `json:"when"`
+	Remote   string    `json:"remote"`
+	Local    string    `json:"local"`
+	Helo     string    `json:"helo"`
+	RDNS     []string  `json:"rdns,omitempty"`
+	TLS      string    `json:"tls,omitempty"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Hash     string    `json:"hash"`
+	BodyHash string    `json:"bodyhash"`
+	Bytes    int       `json:"bytes"`
+	// Why the message was quarantined, if it was.
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+var errNoBody = errors.New("no 'body' line in metadata")
+
+// trimAngles turns '<addr>' into 'addr'.
+func trimAngles(s string) string {
+	if len(s) >= 2 && s[0] == '<' && s[len(s)-1] == '>' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseSaved parses the metadata of a saved message, leaving rdr
+// positioned at the start of the message itself. Unknown metadata
+// lines are skipped so that we can read files written by other
+// versions of sinksmtp.
+func parseSaved(rdr *bufio.Reader) (*savedMsg, error) {
+	sm := &savedMsg{}
+	for {
+		line, err := rdr.ReadString('\n')
+		if err == io.EOF {
+			return nil, errNoBody
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "body" {
+			return sm, nil
+		}
+		idx := strings.IndexByte(line, ' ')
+		if idx == -1 {
+			continue
+		}
+		what, rest := line[:idx], line[idx+1:]
+		switch what {
+		case "id":
+			// id PREFIX RADDR DATE TIME
+			f := strings.Fields(rest)
+			if len(f) != 4 {
+				return nil, fmt.Errorf("bad id line: %s", line)
+			}
+			sm.ID = f[0]
+			sm.When, err = time.ParseInLocation(TimeNZ, f[2]+" "+f[3], time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("bad time in id line: %s", err)
+			}
+		case "remote":
+			// remote RIP to LADDR with helo 'NAME'
+			// The helo name can contain anything, including
+			// spaces and quotes, so it must be taken apart
+			// carefully.
+			idx = strings.Index(rest, " to ")
+			if idx == -1 {
+				return nil, fmt.Errorf("bad remote line: %s", line)
+			}
+			sm.Remote = rest[:idx]
+			rest = rest[idx+len(" to "):]
+			idx = strings.Index(rest, " with helo '")
+			if idx == -1 || !strings.HasSuffix(rest, "'") {
+				return nil, fmt.Errorf("bad remote line: %s", line)
+			}
+			sm.Local = rest[:idx]
+			sm.Helo = rest[idx+len(" with helo '") : len(rest)-1]
+		case "remote-dns":
+			sm.RDNS = strings.Fields(rest)
+		case "tls":
+			sm.TLS = rest
+		case "from":
+			sm.From = trimAngles(rest)
+		case "to":
+			sm.To = append(sm.To, trimAngles(rest))
+		case "hash":
+			// hash HASH bytes NUM
+			idx = strings.LastIndex(rest, "bytes ")
+			if idx == -1 {
+				return nil, fmt.Errorf("bad hash line: %s", line)
+			}
+			sm.Hash = strings.TrimSpace(rest[:idx])
+			sm.Bytes, err = strconv.Atoi(rest[idx+len("bytes "):])
+			if err != nil {
+				return nil, fmt.Errorf("bad size in hash line: %s", err)
+			}
+		case "bodyhash":
+			sm.BodyHash = rest
+		case "quarantine":
+			sm.Quarantine = rest
+		}
+	}
+}
+
+// readSavedMeta reads just the metadata of a saved message file.
+func readSavedMeta(dir, name string) (*savedMsg, error) {
+	fp, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	sm, err := parseSaved(bufio.NewReader(fp))
+	if err != nil {
+		return nil, err
+	}
+	sm.Dir = dir
+	sm.Name = name
+	return sm, nil
+}
+
+// readSaved reads a saved message file, returning the metadata and
+// the raw message.
+func readSaved(dir, name string) (*savedMsg, []byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	rdr := bufio.NewReader(bytes.NewReader(b))
+	sm, err := parseSaved(rdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	sm.Dir = dir
+	sm.Name = name
+	raw, err := ioutil.ReadAll(rdr)
+	return sm, raw, err
+}
+
+// scanSaveDir calls fn for the metadata of every saved message in dir.
+// Files that are not saved messages (including our '.wecanmake' test
+// file and other dotfiles) are skipped.
+func scanSaveDir(dir string, fn func(*savedMsg)) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range fis {
+		if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		sm, err := readSavedMeta(dir, e.Name())
+		if err != nil {
+			continue
+		}
+		fn(sm)
+	}
+	return nil
+}
+
+// indexSaved is called by handleMessage() when it saves a message, to
+// add it to the web interface's list and the full-text index if they
+// are in use.
+func indexSaved(dir, name string, m []byte) {
+	if webIndex == nil && ftidx == nil {
+		return
+	}
+	rdr := bufio.NewReader(bytes.NewReader(m))
+	sm, err := parseSaved(rdr)
+	if err != nil {
+		return
+	}
+	sm.Dir = dir
+	sm.Name = name
+	if webIndex != nil {
+		webIndex.add(sm)
+	}
+	if ftidx != nil {
+		raw, _ := ioutil.ReadAll(rdr)
+		if err := ftidx.add(sm, raw); err != nil {
+			warnf("error adding %s to the index: %s\n", name, err)
+		}
+	}
+}
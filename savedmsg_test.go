@@ -0,0 +1,66 @@
+//
+// Test reading back the metadata of saved messages.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Round trip a message through msgDetails() and parseSaved().
+func TestSavedRoundTrip(t *testing.T) {
+	when := time.Date(2017, 5, 21, 10, 20, 30, 0, time.Local)
+	trans := &smtpTransaction{
+		raddr:    &net.TCPAddr{IP: net.ParseIP("192.168.10.3"), Port: 4000},
+		laddr:    &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 25},
+		rip:      "192.168.10.3",
+		rdns:     &rDNSResults{verified: []string{"a.b.c."}},
+		heloname: "it's 'odd' to helo",
+		from:     "jim@jones.com",
+		rcptto:   []string{"joe@example.com", "bob@example.com"},
+		data:     "Subject: hi\n\nbody text\n",
+		hash:     "abcdef",
+		bodyhash: "123456",
+		when:     when,
+	}
+	m, _ := msgDetails("10/20", trans)
+	rdr := bufio.NewReader(bytes.NewReader(m))
+	sm, err := parseSaved(rdr)
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	switch {
+	case sm.ID != "10/20" || !sm.When.Equal(when):
+		t.Errorf("bad id or time: %s %v", sm.ID, sm.When)
+	case sm.Remote != "192.168.10.3" || sm.Local != "127.0.0.1:25":
+		t.Errorf("bad addresses: %s %s", sm.Remote, sm.Local)
+	case sm.Helo != trans.heloname:
+		t.Errorf("bad helo: '%s'", sm.Helo)
+	case sm.From != "jim@jones.com" || len(sm.To) != 2 || sm.To[1] != "bob@example.com":
+		t.Errorf("bad envelope: %s %v", sm.From, sm.To)
+	case sm.Hash != "abcdef" || sm.BodyHash != "123456" || sm.Bytes != len(trans.data):
+		t.Errorf("bad hashes: %s %s %d", sm.Hash, sm.BodyHash, sm.Bytes)
+	case len(sm.RDNS) != 1 || sm.RDNS[0] != "a.b.c.":
+		t.Errorf("bad rdns: %v", sm.RDNS)
+	}
+	rest, _ := ioutil.ReadAll(rdr)
+	if string(rest) != trans.data {
+		t.Errorf("message body not left in reader: '%s'", rest)
+	}
+
+	trans.quarantine = "SBL listed"
+	m, _ = msgDetails("10/20", trans)
+	sm, err = parseSaved(bufio.NewReader(bytes.NewReader(m)))
+	if err != nil || sm.Quarantine != "SBL listed" {
+		t.Errorf("bad quarantine reason: %v %v", sm, err)
+	}
+
+	if _, err := parseSaved(bufio.NewReader(bytes.NewReader([]byte("id x\n")))); err == nil {
+		t.Errorf("no error on truncated metadata")
+	}
+}
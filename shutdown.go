@@ -0,0 +1,157 @@
+//
+// Graceful shutdown.
+//
+// On SIGTERM or SIGINT we stop accepting new connections and then tell
+// every session to go away with a 421. Sessions that are waiting for
+// a command are interrupted immediately; sessions that are in the
+// middle of receiving or saving a message are left alone to finish
+// that first. We wait up to -stopwait for all sessions to end, then
+// flush our logs and exit. A second signal exits immediately.
+// Upgrades (see upgrade.go) first drain sessions without interrupting
+// them.
+//
+// Idle sessions are interrupted by setting an immediate read deadline
+// on their connection instead of writing to it ourselves, so that the
+// 421 is sent by smtpd (through TLS if the session is using it). smtpd
+// sets its own read deadlines, so an interrupted session's connection
+// sets the immediate one again on every read.
+
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// liveSess is the shutdown state of a single session.
+type liveSess struct {
+	sync.Mutex
+	nc   net.Conn
+	idle bool // waiting for an SMTP command
+	stop bool // we're shutting down and the session should end
+	kick bool // interrupted while idle; reads must fail from now on
+}
+
+// stopConn is a session's connection as smtpd sees it.
+type stopConn struct {
+	net.Conn
+	ls *liveSess
+}
+
+func (sc *stopConn) Read(b []byte) (int, error) {
+	if sc.ls.kicked() {
+		sc.Conn.SetReadDeadline(time.Now())
+	}
+	return sc.Conn.Read(b)
+}
+
+type sessTracker struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	sessions map[*liveSess]bool
+	stopping bool
+}
+
+var liveSessions = &sessTracker{sessions: make(map[*liveSess]bool)}
+
+// add starts tracking a new session. If we are shutting down it
+// returns nil and the session should be closed immediately.
+func (st *sessTracker) add(nc net.Conn) *liveSess {
+	st.Lock()
+	defer st.Unlock()
+	if st.stopping {
+		return nil
+	}
+	ls := &liveSess{nc: nc}
+	st.sessions[ls] = true
+	st.wg.Add(1)
+	return ls
+}
+
+func (st *sessTracker) done(ls *liveSess) {
+	st.Lock()
+	delete(st.sessions, ls)
+	st.Unlock()
+	st.wg.Done()
+}
+
+// waitCommand is called just before a session calls smtpd to get
+// the next thing from the client, which is a message instead of a
+// command if indata is set. It returns true if the session should
+// instead tell the client that we're going away.
+func (ls *liveSess) waitCommand(indata bool) bool {
+	ls.Lock()
+	defer ls.Unlock()
+	if indata {
+		ls.idle = false
+		return false
+	}
+	ls.idle = !ls.stop
+	return ls.stop
+}
+
+// busy is called when a session has gotten something from smtpd
+// and is going to act on it. It returns true if the session was
+// interrupted by a shutdown.
+func (ls *liveSess) busy() bool {
+	ls.Lock()
+	defer ls.Unlock()
+	wasidle := ls.idle
+	ls.idle = false
+	return wasidle && ls.stop
+}
+
+// interrupt tells a session to stop, kicking it out of waiting for a
+// command if necessary.
+func (ls *liveSess) interrupt() {
+	ls.Lock()
+	ls.stop = true
+	if ls.idle {
+		ls.kick = true
+		ls.nc.SetReadDeadline(time.Now())
+	}
+	ls.Unlock()
+}
+
+func (ls *liveSess) kicked() bool {
+	ls.Lock()
+	defer ls.Unlock()
+	return ls.kick
+}
+
+// shutdown stops all current sessions and waits up to wait for them
+// to finish. It returns false if they didn't all finish in time.
+func (st *sessTracker) shutdown(wait time.Duration) bool {
+	st.Lock()
+	st.stopping = true
+	for ls := range st.sessions {
+		ls.interrupt()
+	}
+	st.Unlock()
+	return st.drain(wait)
+}
+
+// drain waits up to wait for all current sessions to finish on their
+// own. It returns false if they didn't.
+func (st *sessTracker) drain(wait time.Duration) bool {
+	donec := make(chan struct{})
+	go func() {
+		st.wg.Wait()
+		close(donec)
+	}()
+	select {
+	case <-donec:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+// syncLog flushes a log file to disk if it is a real file.
+func syncLog(w interface{}) {
+	if fp, ok := w.(*os.File); ok && fp != os.Stdout {
+		fp.Sync()
+	}
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"container/list"
 	"crypto/sha1"
 	"crypto/tls"
 	"expvar"
@@ -18,10 +19,12 @@ import (
 	_ "net/http/pprof"
 	"net/mail"
 	"os"
+	"os/signal"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/siebenmann/smtpd"
@@ -41,6 +44,11 @@ var events struct {
 	yakads, yakforces                             expvar.Int
 	notlscnt                                      expvar.Int
 	abandons, refuseds                            expvar.Int
+	connlimits, iplimits                          expvar.Int
+	timeouts, proxyerrs                           expvar.Int
+	greylisted, greyretries, greypassed           expvar.Int
+	tarpits, delays, drops                        expvar.Int
+	discards, quarantines                         expvar.Int
 }
 
 // TimeNZ is our message/logging time format; it's time without the timezone.
@@ -146,6 +154,10 @@ func loadRules(fname string) ([]*Rule, error) {
 	if err != nil {
 		return nil, fmt.Errorf("rules parsing error %v", err)
 	}
+	// This makes it a startup error, like other rules problems.
+	if quarantineDir == "" && usesQuarantine(rl) {
+		return nil, errNoQuarantine
+	}
 	return rl, nil
 }
 
@@ -193,38 +205,109 @@ func setupRules(baserules []*Rule) ([]*Rule, bool) {
 // Support for IP blacklists. We have two.
 //
 // notls is a blacklist of IPs that have TLS problems when talking to
-// us. If an IP is present and is more recent than tlsTimeout (3
-// days), we don't advertise TLS to them even if we could.
+// us. If an IP has -tlsfails failures within tlsTimeout (by default
+// two in 3 days), we don't advertise TLS to them even if we could.
 //
 // yakkers is a blacklist of people who have made too many connections
 // to us that they didn't do anything meaningful with within a certain
-// period of time. Implicitly this is yakTimeout. Yakkers get a 'stall
-// all' timeout.
-
-const tlsTimeout = time.Hour * 72
+// period of time. Implicitly this is yakTimeout. By default yakkers get
+// a 'stall all' timeout; see policy.go.
+//
+// yaknets does the same thing for networks, with -dnprefix4 and
+// -dnprefix6 setting how big they are; a network with too many
+// do-nothing connections from any of its IPs is a yakker too. A
+// client that does something clears both itself and its network.
+//
+// Entries that are never looked up again would stay around forever,
+// so a sweeper periodically removes expired ones. Each map is also
+// limited to a maximum size, past which the least recently used
+// entries are evicted.
 
 // Theoretically redundant in the face of flag settings.
 var yakTimeout = time.Hour * 8
 var yakCount = 5
 
+// Network yakker tracking prefix lengths; 0 turns it off.
+var yakPrefix4, yakPrefix6 int
+
+// yakNet returns the yakker network for ip, or "" if there is none.
+func yakNet(ip string) string {
+	pip := net.ParseIP(ip)
+	if pip == nil || (pip.To4() != nil && yakPrefix4 == 0) || (pip.To4() == nil && yakPrefix6 == 0) {
+		return ""
+	}
+	return ipNet(ip, yakPrefix4, yakPrefix6)
+}
+
+// How often the sweeper removes expired entries.
+const ipMapSweep = 10 * time.Minute
+
 type ipEnt struct {
 	when  time.Time
 	count int
+	elem  *list.Element // our place in ipMap.lru
 }
 type ipMap struct {
 	sync.Mutex
 	ips   map[string]*ipEnt
+	lru   *list.List // of IPs, most recently used first
+	max   int        // maximum size; 0 is unlimited
 	stats struct {
 		// Size is not valid on the fly. Life is like that!
 		Size, Adds, AddsNew, AddsExpired, Dels, Sets int
 		// We count hits instead of misses because misses
 		// are the normal case.
 		Lookup, LookupHit, LookupExpired int
+		Pruned, Sweeps, Evicted          int
+	}
+}
+
+// use marks an entry as the most recently used one and evicts the
+// least recently used ones if we're now too big. It must be called
+// with the lock held whenever an entry is added or used.
+func (i *ipMap) use(ip string, t *ipEnt) {
+	if i.lru == nil {
+		i.lru = list.New()
 	}
+	if t.elem == nil {
+		t.elem = i.lru.PushFront(ip)
+	} else {
+		i.lru.MoveToFront(t.elem)
+	}
+	for i.max > 0 && len(i.ips) > i.max && i.lru.Len() > 1 {
+		e := i.lru.Back()
+		i.lru.Remove(e)
+		eip := e.Value.(string)
+		if et := i.ips[eip]; et != nil && et.elem == e {
+			delete(i.ips, eip)
+			i.stats.Evicted++
+		}
+	}
+}
+
+// remove removes an entry. It must be called with the lock held.
+func (i *ipMap) remove(ip string) {
+	t := i.ips[ip]
+	if t == nil {
+		return
+	}
+	if t.elem != nil && i.lru != nil {
+		i.lru.Remove(t.elem)
+	}
+	delete(i.ips, ip)
+}
+
+// insert replaces any existing entry for ip with t. It must be called
+// with the lock held.
+func (i *ipMap) insert(ip string, t *ipEnt) {
+	i.remove(ip)
+	i.ips[ip] = t
+	i.use(ip, t)
 }
 
 var notls = &ipMap{ips: make(map[string]*ipEnt)}
 var yakkers = &ipMap{ips: make(map[string]*ipEnt)}
+var yaknets = &ipMap{ips: make(map[string]*ipEnt)}
 
 // We must take a TTL because we want to annul the count of existing
 // but stale entries. Right now this only matters for yakkers, which
@@ -248,6 +331,7 @@ func (i *ipMap) Add(ip string, ttl time.Duration) int {
 	}
 	t.count++
 	t.when = time.Now()
+	i.use(ip, t)
 	cnt := t.count
 	i.Unlock()
 	return cnt
@@ -275,6 +359,7 @@ func (i *ipMap) Set(ip string, ttl time.Duration, cnt int) int {
 	t.when = time.Now()
 	ocnt := t.count
 	t.count = cnt
+	i.use(ip, t)
 	i.Unlock()
 	return ocnt
 }
@@ -288,10 +373,28 @@ func (i *ipMap) Del(ip string) {
 	// because I am crazy that way.
 	if _, ok := i.ips[ip]; ok {
 		i.stats.Dels++
-		delete(i.ips, ip)
+		i.remove(ip)
 	}
 	i.Unlock()
 }
+
+// Dec takes one off the count for ip, removing it if the count
+// drops to zero.
+func (i *ipMap) Dec(ip string) {
+	if ip == "" {
+		return
+	}
+	i.Lock()
+	if t, ok := i.ips[ip]; ok {
+		t.count--
+		if t.count <= 0 {
+			i.stats.Dels++
+			i.remove(ip)
+		}
+	}
+	i.Unlock()
+}
+
 func (i *ipMap) Lookup(ip string, ttl time.Duration) (bool, int) {
 	i.Lock()
 	// we defer the unlock because we now increment stats later.
@@ -303,17 +406,52 @@ func (i *ipMap) Lookup(ip string, ttl time.Duration) (bool, int) {
 	}
 	if time.Since(t.when) < ttl {
 		i.stats.LookupHit++
+		i.use(ip, t)
 		return true, t.count
 	}
 	i.stats.LookupExpired++
 	// NOTE: we cannot call i.Del() here because that would attempt
-	// to lock again. So we must delete directly. This has the side
+	// to lock again. So we must remove directly. This has the side
 	// effect of not increasing stats.Dels; an expired lookup implies
 	// a delete.
-	delete(i.ips, ip)
+	i.remove(ip)
 	return false, 0
 }
 
+// prune removes all entries older than ttl and returns how many it
+// removed.
+func (i *ipMap) prune(ttl time.Duration) int {
+	i.Lock()
+	defer i.Unlock()
+	cnt := 0
+	for ip, t := range i.ips {
+		if time.Since(t.when) >= ttl {
+			i.remove(ip)
+			cnt++
+		}
+	}
+	i.stats.Pruned += cnt
+	return cnt
+}
+
+// ipMapSweeper removes expired entries from the yakker and notls
+// tables every so often.
+func ipMapSweeper() {
+	for {
+		time.Sleep(ipMapSweep)
+		for _, m := range []*ipMap{yakkers, yaknets, notls, greypend, greypass} {
+			m.Lock()
+			m.stats.Sweeps++
+			m.Unlock()
+		}
+		yakkers.prune(yakTimeout)
+		yaknets.prune(yakTimeout)
+		notls.prune(tlsTimeout)
+		greypend.prune(greyWindow)
+		greypass.prune(greyLife)
+	}
+}
+
 // This is a hack. We feed this to expvar.Func().
 func (i *ipMap) Stats() interface{} {
 	i.Lock()
@@ -392,6 +530,7 @@ func (log *smtpLogger) Write(b []byte) (n int, err error) {
 // messages were delivered over the same Conn, some parts of this will
 // be reused.
 type smtpTransaction struct {
+	id           string // our connection ID, the log prefix
 	raddr, laddr net.Addr
 	rip          string
 	lip          string
@@ -409,7 +548,8 @@ type smtpTransaction struct {
 	bodyhash string    // canonical hash of the message body (no headers)
 	when     time.Time // when the email message data was received.
 
-	savedir string // directory to save message to
+	savedir    string // directory to save message to
+	quarantine string // why the message is quarantined, if it is
 
 	// Reflects the current state, so tlson false can convert to
 	// tlson true over time. cipher is valid only if tlson is true.
@@ -424,6 +564,17 @@ type smtpTransaction struct {
 	lastamsg string
 
 	lastresgood bool // last result from decider()
+
+	// Whether the client was a yakker or had too many TLS
+	// failures when it connected, for rules.
+	yakker, tlsfailed bool
+
+	dropped bool // a drop rule matched; close the connection
+
+	// where the time went in this session; see timing.go
+	timing *sessTiming
+	// running data for the session summary; see summary.go
+	sess *sessStats
 }
 
 // returns overall hash and body-of-message hash. The latter may not
@@ -515,6 +666,9 @@ func msgDetails(prefix string, trans *smtpTransaction) ([]byte, string) {
 	}
 	fmt.Fprintf(writer, "hash %s bytes %d\n", trans.hash, len(trans.data))
 	fmt.Fprintf(writer, "bodyhash %s\n", trans.bodyhash)
+	if trans.quarantine != "" {
+		fmt.Fprintf(writer, "quarantine %s\n", trans.quarantine)
+	}
 	fmt.Fprintf(writer, "body\n%s", trans.data)
 	writer.Flush()
 	metahash := genHash(outbuf2.Bytes())
@@ -601,6 +755,9 @@ func handleMessage(prefix string, trans *smtpTransaction, logf io.Writer) (strin
 		if err != nil {
 			warnf("error closing message file: %s\n", err)
 		}
+		if err == nil {
+			indexSaved(trans.savedir, hash, m)
+		}
 	} else if !os.IsExist(err) {
 		warnf("error writing message file: %v\n", err)
 	} else {
@@ -615,7 +772,9 @@ func getSBLHits(t *smtpTransaction) []string {
 	// since we know this hit, we can omit a lot of checks.
 	s := strings.Split(t.rip, ".")
 	ln := fmt.Sprintf("%s.%s.%s.%s.sbl.spamhaus.org.", s[3], s[2], s[1], s[0])
+	start := time.Now()
 	txts, err := net.LookupTXT(ln)
+	noteDNS(t, "sbl", start)
 	if err != nil {
 		return sbls
 	}
@@ -695,7 +854,27 @@ func doAccept(convo *smtpd.Conn, c *Context, transid string) {
 // Returns false if the message was accepted, true if decider() handled
 // a rejection or tempfail.
 func decider(ph Phase, evt smtpd.EventInfo, c *Context, convo *smtpd.Conn, id string, trans *smtpTransaction) bool {
-	res := Decide(ph, evt, c)
+	// pConnect is timed by our caller, since it also wants to
+	// include the rDNS lookup and so on.
+	if ph != pConnect {
+		defer notePhase(trans, ph.String()[1:], time.Now())
+	}
+	return decided(ph, Decide(ph, evt, c), evt, c, convo, id, trans)
+}
+
+// decided is the rest of decider(), for when our caller has already
+// run the rules and has their result in res.
+func decided(ph Phase, res Action, evt smtpd.EventInfo, c *Context, convo *smtpd.Conn, id string, trans *smtpTransaction) bool {
+	trans.sess.action = res
+	trans.sess.rule = c.rule
+	if res != aNoresult {
+		ev := &liveEvent{Type: "decision", Phase: phaseName(ph),
+			Action: res.String()}
+		if c.rule != nil {
+			ev.Rule = c.rule.String()
+		}
+		publishEvent(trans, ev)
+	}
 
 	logDnsbls(c)
 	// Terrible hack to log DNS lookup failure specifics.
@@ -730,18 +909,44 @@ func decider(ph Phase, evt smtpd.EventInfo, c *Context, convo *smtpd.Conn, id st
 		}
 	}
 
+	// A rule delay holds up this reply; otherwise tarpitting slows
+	// down this and all later replies. Tarpit rules don't decide
+	// anything, so Decide() only tells us about them as a property.
+	if d := c.withprops["delay"]; d != "" {
+		// The parser has already checked that it's valid.
+		dur, _ := time.ParseDuration(d)
+		events.delays.Add(1)
+		time.Sleep(dur)
+	} else if tp := c.withprops["tarpit"]; tp != "" {
+		dur, _ := time.ParseDuration(tp)
+		if convo.Config.Delay != dur {
+			writeLog(trans.log, "! tarpitting %s at %s\n", trans.rip, phaseName(ph))
+			events.tarpits.Add(1)
+			convo.Config.Delay = dur
+		}
+	}
+	// Our caller has already handled discards and quarantines
+	// at @message, and they're accepts as far as the client knows.
+	if res == aDiscard || res == aQuarantine {
+		res = aAccept
+	}
 	if res == aNoresult || res == aAccept {
 		trans.lastresgood = true
 		return false
 	}
 	trans.lastresgood = false
 
+	if res == aDrop {
+		writeLog(trans.log, "! %s dropped at %s due to rule: %s\n", trans.rip, time.Now().Format(smtpd.TimeFmt), c.rule)
+		events.drops.Add(1)
+		trans.dropped = true
+	}
 	if ph == pConnect {
 		// TODO: have some way to stall or reject connections
 		// in smtpd. Or should that be handled outside of it?
 		// Right now a reject result means 'drop', stall will
 		// implicitly cause us to go on.
-		return res == aReject
+		return res == aReject || res == aDrop
 	}
 
 	msg := c.withprops["message"]
@@ -774,12 +979,45 @@ func decider(ph Phase, evt smtpd.EventInfo, c *Context, convo *smtpd.Conn, id st
 		} else {
 			convo.Tempfail()
 		}
+	case aGreylist:
+		if msg == "" {
+			msg = "Greylisted, please try again later"
+		}
+		convo.TempfailMsg(msg)
+	case aDrop:
+		// Our caller closes the connection, sending any message
+		// as a 421 with sendDrop().
 	default:
 		panic("impossible res")
 	}
 	return true
 }
 
+// reply421 formats msg, which may have several lines, as a 421 reply.
+func reply421(msg string) string {
+	lines := strings.Split(msg, "\n")
+	var r string
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		r += "421" + sep + l + "\r\n"
+	}
+	return r
+}
+
+// sendDrop sends the message of a rule that dropped the connection,
+// if it has one, as a 421 reply.
+func sendDrop(conn net.Conn, c *Context) {
+	msg := c.withprops["message"]
+	if msg == "" {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte(reply421(msg)))
+}
+
 func writeLog(logger *smtpLogger, format string, elems ...interface{}) {
 	if logger == nil {
 		return
@@ -788,16 +1026,22 @@ func writeLog(logger *smtpLogger, format string, elems ...interface{}) {
 	logger.Write([]byte(s))
 }
 
-func yakLog(dnlog io.Writer, trans *smtpTransaction, prefix, what string) {
+// yakLog logs something about a yakker. level is what tripped: the
+// IP itself ("") or its network, for network yakker tracking.
+func yakLog(dnlog io.Writer, trans *smtpTransaction, prefix, what, level string) {
 	if dnlog == nil {
 		return
 	}
-	fmt.Fprintf(dnlog, "%s [%s] %s %s -> %s\n", time.Now().Format(TimeNZ),
-		prefix, what, trans.rip, trans.laddr)
+	by := ""
+	if level != "" {
+		by = " by net " + level
+	}
+	fmt.Fprintf(dnlog, "%s [%s] %s %s -> %s%s\n", time.Now().Format(TimeNZ),
+		prefix, what, trans.rip, trans.laddr, by)
 }
 
 // Process a single connection.
-func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtplog io.Writer, dnlog io.Writer, baserules []*Rule) {
+func process(cid int, nc net.Conn, lo *listenOpts, certs []tls.Certificate, logf io.Writer, smtplog io.Writer, dnlog io.Writer, sumlog io.Writer, baserules []*Rule) {
 	var evt smtpd.EventInfo
 	var convo *smtpd.Conn
 	var logger *smtpLogger
@@ -807,15 +1051,42 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 
 	defer nc.Close()
 
+	if lo.proxy {
+		pnc, err := readProxy(nc)
+		if err != nil {
+			events.proxyerrs.Add(1)
+			warnonce("%s\n", err)
+			return
+		}
+		nc = pnc
+	}
+
+	ls := liveSessions.add(nc)
+	if ls == nil {
+		// we're shutting down.
+		return
+	}
+	defer liveSessions.done(ls)
+
 	trans := &smtpTransaction{}
+	trans.timing = newSessTiming()
+	trans.sess = newSessStats()
 	trans.savedir = savedir
 	trans.raddr = nc.RemoteAddr()
 	trans.laddr = nc.LocalAddr()
 	laddrstr := trans.laddr.String()
 	prefix := fmt.Sprintf("%d/%d", os.Getpid(), cid)
+	trans.id = prefix
 	trans.rip, _, _ = net.SplitHostPort(trans.raddr.String())
 	trans.lip, _, _ = net.SplitHostPort(laddrstr)
 
+	if why := conns.add(trans.rip); why != "" {
+		refuseConn(nc, why)
+		return
+	}
+	defer conns.done(trans.rip)
+	rates.add(rConn, trans.rip)
+
 	loccounts.Add([]string{laddrstr})
 
 	var c *Context
@@ -834,20 +1105,38 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 	// 'bad' session if we don't get far enough. Sessions with TLS
 	// errors don't count, as do sessions with bad rules or sessions
 	// where yakCount == 0.
-	sesscounts = rulesgood && yakCount > 0
+	// Clients without an IP address (on Unix domain sockets) can't
+	// be tracked.
+	sesscounts = rulesgood && yakCount > 0 && trans.rip != ""
+	// With network yakker tracking, the client's network can also
+	// be a yakker even if the client itself isn't (yet).
+	yaknet := yakNet(trans.rip)
 	hit, cnt := yakkers.Lookup(trans.rip, yakTimeout)
-	if yakCount > 0 && hit && cnt >= yakCount && smtplog != nil {
+	nhit, ncnt := yaknets.Lookup(yaknet, yakTimeout)
+	yaklevel := ""
+	if !(hit && cnt >= yakCount) {
+		hit, yaklevel = nhit && ncnt >= yakCount, yaknet
+	}
+	trans.yakker = yakCount > 0 && hit
+	if trans.yakker && smtplog != nil {
 		// nit: if the rules are bad and we're stalling anyways,
 		// yakkers still have their SMTP transactions not logged.
-		c = newContext(trans, stallall)
-		stall = true
+		// Yakkers left to the rules are handled like anyone
+		// else, except that they're not counted again.
+		if !rulesgood {
+			c = newContext(trans, rules)
+		} else {
+			c = newContext(trans, yakRules(rules))
+		}
+		stall = yakAction != "rules"
 		sesscounts = false
+		trans.sess.yakker = yakActions[yakAction]
 		events.yakkers.Add(1)
 		updateTimeOf("yakker", laddrstr)
 		// Log one line of information about this yakker.
 		// It would be potentially interesting to find out how old
 		// this yakker entry is, but we can't get that right now.
-		yakLog(dnlog, trans, prefix, "connection")
+		yakLog(dnlog, trans, prefix, "connection", yaklevel)
 	} else {
 		c = newContext(trans, rules)
 		updateTimeOf("regular", laddrstr)
@@ -861,16 +1150,44 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 		trans.log = logger
 		l2 = logger
 	}
+	// Sessions can end in several places, so the timing breakdown
+	// and the session summary are logged on the way out.
+	cc := &countConn{Conn: &stopConn{Conn: nc, ls: ls}}
+	defer func() {
+		phaseTimes["session"].Observe(time.Since(trans.timing.start))
+		writeLog(logger, "! timing: %s\n", trans.timing)
+		if convo != nil {
+			trans.tlson = convo.TLSOn
+			trans.cipher = convo.TLSState.CipherSuite
+			trans.servername = convo.TLSState.ServerName
+			trans.tlsversion = convo.TLSState.Version
+		}
+		logSummary(sumlog, prefix, trans, cc)
+		publishEvent(trans, &liveEvent{Type: "end",
+			Phase: phaseName(trans.sess.phase), Action: trans.sess.end})
+	}()
+	publishEvent(trans, &liveEvent{Type: "connect"})
+	if stall && yakAction == "drop" {
+		trans.sess.end = "dropped"
+		return
+	}
 
 	sname := laddrstr
 	if srvname != "" {
 		sname = srvname
+	} else if trans.lip == "" {
+		// Unix domain sockets have no IP address to look up.
+		if hn, err := os.Hostname(); err == nil {
+			sname = hn
+		}
 	} else {
 		lip, _, _ := net.SplitHostPort(sname)
 		// we don't do a verified lookup of the local IP address
 		// because it's theoretically under your control, so if
 		// you want to forge stuff that's up to you.
+		start := time.Now()
 		nlst, err := net.LookupAddr(lip)
+		noteDNS(trans, "localname", start)
 		if err == nil && len(nlst) > 0 {
 			sname = nlst[0]
 			if sname[len(sname)-1] == '.' {
@@ -879,6 +1196,7 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 		}
 	}
 
+	tmo := sessTimeouts{cmdTimeout, dataTimeout, maxSession}
 	if connfile != "" {
 		dm, err := loadConnFile(connfile)
 		if err != nil {
@@ -891,29 +1209,42 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 				sname = pd.myname
 			}
 			certs = pd.certs
+			tmo.override(pd)
 		}
 	}
+	if tmo.session > 0 {
+		t := time.AfterFunc(tmo.session, cc.expire)
+		defer t.Stop()
+	}
 
 	cfg.LocalName = sname
 	cfg.SayTime = true
 	cfg.SftName = "sinksmtp"
 	cfg.Announce = "This server does not deliver email."
+	cfg.Limits = tmo.limits()
 
 	// stalled conversations are always slow, even if -S is not set.
 	// TODO: make them even slower than this? I probably don't care.
 	if goslow || stall {
 		cfg.Delay = time.Second / 10
 	}
+	if stall && yakAction == "tarpit" {
+		cfg.Delay = tarpitDelay
+	}
 
 	// Don't offer TLS to hosts that have too many TLS failures.
-	// We give hosts *two* tries at setting up TLS because some
+	// By default we give hosts *two* tries at setting up TLS because some
 	// hosts start by offering SSLv2, which is an instant-fail,
 	// even if they support stuff that we do. We hope that their
 	// SSLv2 failure will cause them to try again in another
 	// connection with TLS only.
 	// See https://code.google.com/p/go/issues/detail?id=3930
+	// On tls: listeners there's nothing to fall back to, so past
+	// failures don't matter.
 	blocktls, blcount := notls.Lookup(trans.rip, tlsTimeout)
-	if len(certs) > 0 && !(blocktls && blcount >= 2) {
+	trans.tlsfailed = blocktls && blcount >= tlsFails
+	blocktls = trans.tlsfailed && !lo.tls
+	if len(certs) > 0 && !blocktls {
 		var tlsc tls.Config
 		tlsc.Certificates = certs
 		// if there is already one TLS failure for this host,
@@ -936,19 +1267,60 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 		tlsc.BuildNameToCertificate()
 		cfg.TLSConfig = &tlsc
 	}
-	if blocktls && blcount >= 2 {
+	if blocktls {
 		// We don't need to check for certificate length, because
 		// this can only happen if TLS is enabled and available.
 		events.notlscnt.Add(1)
+		trans.sess.notls = true
+	}
+
+	// On tls: listeners TLS comes before anything else. Handshake
+	// failures count just like STARTTLS ones.
+	var tc *tls.Conn
+	if lo.tls {
+		if cfg.TLSConfig == nil {
+			warnonce("no TLS certificates for tls: listener %s\n", laddrstr)
+			trans.sess.end = "tls-failed"
+			return
+		}
+		var err error
+		tc, err = tlsHandshake(cc, cfg.TLSConfig, tmo.tlsSetup())
+		if err != nil {
+			notls.Add(trans.rip, tlsTimeout)
+			trans.sess.tlserrs++
+			events.tlserrs.Add(1)
+			writeLog(logger, "! TLS handshake with %s failed at %s: %s\n", trans.rip, time.Now().Format(smtpd.TimeFmt), err)
+			trans.sess.end = "tls-failed"
+			return
+		}
+		// There's no STARTTLS inside TLS.
+		cfg.TLSConfig = nil
+	}
+
+	var sconn net.Conn = cc
+	if tc != nil {
+		sconn = tc
+	}
+	var lc *lmtpConn
+	if lo.lmtp {
+		lc = newLMTPConn(sconn)
+		sconn = lc
+		cfg.TLSConfig = nil
 	}
 
 	// With everything set up we can now create the connection.
-	convo = smtpd.NewConn(nc, cfg, l2)
+	convo = smtpd.NewConn(sconn, cfg, l2)
+	if tc != nil {
+		convo.TLSOn = true
+		convo.TLSState = tc.ConnectionState()
+	}
 
 	// Yes, we do rDNS lookup before our initial greeting banner and
 	// thus can pause a bit here. Clients will cope, or at least we
 	// don't care if impatient ones don't.
+	start := time.Now()
 	trans.rdns, _ = LookupAddrVerified(trans.rip)
+	noteDNS(trans, "rdns", start)
 
 	// Check for an immediate result on the initial connection. This
 	// may disable TLS or refuse things immediately.
@@ -957,22 +1329,59 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 	if decider(pConnect, evt, c, convo, "", trans) {
 		// TODO: somehow write a message and maybe log it.
 		// this probably needs smtpd.go cooperation.
-		// Right now we just close abruptly.
-		if !stall {
+		// Right now we just close abruptly, except that a drop
+		// with a message sends it as a 421 in place of our
+		// greeting. (Drops have already been logged.)
+		if trans.dropped {
+			sendDrop(sconn, c)
+		}
+		if !stall && !trans.dropped {
 			writeLog(logger, "! %s dropped on connect due to rule at %s\n", trans.rip, time.Now().Format(smtpd.TimeFmt))
 		}
+		trans.sess.end = "dropped"
 		return
 	}
+	notePhase(trans, "connect", trans.timing.start)
 
 	// Main transaction loop. We gather up email messages as they come
 	// in, possibly failing various operations as we're told to.
+	var datastart time.Time
+	var indata bool
 	for {
-		evt = convo.Next()
+		// Dropped sessions still count for do-nothing client
+		// tracking, so that 'with make-yakker' works.
+		if trans.dropped {
+			sendDrop(sconn, c)
+			trans.sess.end = "dropped"
+			break
+		}
+		// Shutting down is only noticed between commands, so that
+		// messages being received get finished and saved.
+		stopping := ls.waitCommand(indata)
+		if !stopping {
+			evt = convo.Next()
+			stopping = ls.busy()
+		}
+		if stopping {
+			writeLog(logger, "! shutting down at %s\n", time.Now().Format(smtpd.TimeFmt))
+			convo.TempfailMsg("Server shutting down")
+			trans.sess.end = "shutdown"
+			return
+		}
+		wasdata := indata
+		indata = false
 		switch evt.What {
 		case smtpd.COMMAND:
+			publishEvent(trans, &liveEvent{Type: "command",
+				Cmd: cmdNames[evt.Cmd], Arg: evt.Arg})
 			switch evt.Cmd {
 			case smtpd.EHLO, smtpd.HELO:
 				events.ehlo.Add(1)
+				if evt.Cmd == smtpd.EHLO {
+					trans.sess.commands["ehlo"]++
+				} else {
+					trans.sess.commands["helo"]++
+				}
 				if decider(pHelo, evt, c, convo, "", trans) {
 					continue
 				}
@@ -986,12 +1395,16 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 					gotsomewhere = true
 				}
 				events.ehloAccept.Add(1)
+				trans.sess.reached(pHelo)
 				if convo.TLSOn {
 					events.tlson.Add(1)
-					events.starttls.Add(1)
+					if !lo.tls {
+						events.starttls.Add(1)
+					}
 				}
 			case smtpd.MAILFROM:
 				events.mailfrom.Add(1)
+				trans.sess.commands["mailfrom"]++
 				if decider(pMfrom, evt, c, convo, "", trans) {
 					continue
 				}
@@ -1013,6 +1426,8 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 						events.rsetdrops.Add(1)
 						writeLog(logger, "! %s added as a yakker at hit %d due to RSET\n", trans.rip, cnt)
 						convo.TempfailMsg("Too many unsuccessful delivery attempts")
+						trans.sess.yakker = "rset-drop"
+						trans.sess.end = "rset-drop"
 						// this will implicitly close
 						// the connection.
 						return
@@ -1026,9 +1441,16 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 				}
 				doAccept(convo, c, "")
 				events.mailfromAccept.Add(1)
+				trans.sess.reached(pMfrom)
 			case smtpd.RCPTTO:
 				events.rcptto.Add(1)
+				trans.sess.commands["rcptto"]++
 				if decider(pRto, evt, c, convo, "", trans) {
+					// Greylisted clients have done all
+					// they can until they retry.
+					if trans.sess.action == aGreylist {
+						gotsomewhere = true
+					}
 					continue
 				}
 				trans.rcptto = append(trans.rcptto, evt.Arg)
@@ -1037,19 +1459,32 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 				}
 				doAccept(convo, c, "")
 				events.rcpttoAccept.Add(1)
+				trans.sess.reached(pRto)
 			case smtpd.DATA:
 				events.data.Add(1)
+				trans.sess.commands["data"]++
 				if decider(pData, evt, c, convo, "", trans) {
 					continue
 				}
 				if minphase == "data" {
 					gotsomewhere = true
 				}
+				if lc != nil {
+					lc.replyTo(len(trans.rcptto))
+				}
 				doAccept(convo, c, "")
 				events.dataAccept.Add(1)
+				trans.sess.reached(pData)
+				datastart = time.Now()
+				indata = true
 			}
 		case smtpd.GOTDATA:
 			events.messages.Add(1)
+			rates.add(rMsg, trans.rip)
+			notePhase(trans, "transfer", datastart)
+			trans.sess.messages++
+			trans.sess.msgbytes += len(evt.Arg)
+			trans.sess.reached(pMessage)
 			// -minphase=message means 'message
 			// successfully transmitted to us' as opposed
 			// to 'message accepted'.
@@ -1065,7 +1500,29 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 			trans.servername = convo.TLSState.ServerName
 			trans.tlsversion = convo.TLSState.Version
 			trans.hash, trans.bodyhash = getHashes(trans)
+			// Discard and quarantine rules decide whether and
+			// where the message is saved, so we need to know
+			// about them first.
+			start := time.Now()
+			res := Decide(pMessage, evt, c)
+			notePhase(trans, "message", start)
+			savedir := trans.savedir
+			switch res {
+			case aDiscard:
+				writeLog(logger, "! message discarded due to rule: %s\n", c.rule)
+				events.discards.Add(1)
+				trans.savedir = ""
+			case aQuarantine:
+				trans.quarantine = quarantineReason(c)
+				trans.savedir = quarantineDir
+				writeLog(logger, "! message quarantined: %s\n", trans.quarantine)
+				events.quarantines.Add(1)
+			}
 			transid, err := handleMessage(prefix, trans, logf)
+			trans.savedir, trans.quarantine = savedir, ""
+			publishEvent(trans, &liveEvent{Type: "message",
+				Hash: trans.hash, Bytes: len(trans.data),
+				Arg: transid})
 			// errors when handling a message always force
 			// a tempfail regardless of how we're
 			// configured.
@@ -1073,7 +1530,7 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 			case err != nil:
 				convo.Tempfail()
 				gotsomewhere = true
-			case decider(pMessage, evt, c, convo, transid, trans):
+			case decided(pMessage, res, evt, c, convo, transid, trans):
 				// do nothing, already handled
 			default:
 				if minphase == "accepted" {
@@ -1087,14 +1544,22 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 			// to this source IP for a while.
 			notls.Add(trans.rip, tlsTimeout)
 			sesscounts = false
+			trans.sess.tlserrs++
 			events.tlserrs.Add(1)
 			events.starttls.Add(1)
 		}
 		if evt.What == smtpd.DONE || evt.What == smtpd.ABORT {
 			if evt.What == smtpd.DONE {
 				events.quits.Add(1)
+				trans.sess.end = "quit"
 			} else {
 				events.aborts.Add(1)
+				trans.sess.end = "abort"
+				if why := tmo.reason(cc, wasdata); why != "" {
+					events.timeouts.Add(1)
+					trans.sess.timeout = why
+					writeLog(logger, "! timeout: %s at %s\n", why, time.Now().Format(smtpd.TimeFmt))
+				}
 			}
 			break
 		}
@@ -1106,7 +1571,7 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 	// And we have to have good rules to start with because duh.
 	_, forceyakker := c.withprops["make-yakker"]
 	switch {
-	case forceyakker:
+	case forceyakker && trans.rip != "":
 		// It's a lot simpler if forced yakking takes priority
 		// over everything else.
 		cnt = yakkers.Set(trans.rip, yakTimeout, yakCount)
@@ -1115,25 +1580,41 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 		// from it.
 		if cnt != yakCount {
 			writeLog(logger, "! %s forced to be a yakker\n", trans.rip)
+			trans.sess.yakker = "forced"
 			events.yakads.Add(1)
 			events.yakforces.Add(1)
-			yakLog(dnlog, trans, prefix, "force-set")
+			yakLog(dnlog, trans, prefix, "force-set", "")
 		}
 	case !gotsomewhere && sesscounts:
 		cnt = yakkers.Add(trans.rip, yakTimeout)
+		ncnt = yaknets.Add(yaknet, yakTimeout)
+		trans.sess.yakker = "counted"
 		// See if this transaction has pushed the client over the
 		// edge to becoming a yakker. If so, report it to the SMTP
 		// log.
 		// We report yakker addition only once. This is safe even
 		// with multiple sessions happening at once because we know
 		// that *some* session will have exactly hit the yakker count.
-		if cnt == yakCount {
+		switch {
+		case cnt == yakCount:
 			writeLog(logger, "! %s added as a yakker at hit %d\n", trans.rip, cnt)
+			trans.sess.yakker = "added"
+			events.yakads.Add(1)
+			yakLog(dnlog, trans, prefix, "added", "")
+		case ncnt == yakCount:
+			writeLog(logger, "! %s added as a yakker network at hit %d from %s\n", yaknet, ncnt, trans.rip)
+			trans.sess.yakker = "added"
 			events.yakads.Add(1)
-			yakLog(dnlog, trans, prefix, "added")
+			yakLog(dnlog, trans, prefix, "added", yaknet)
 		}
 	case yakCount > 0 && gotsomewhere:
+		// A client that does something only takes one off its
+		// network's count, so that a real mail server isn't
+		// stuck behind others on its network but one client
+		// can't wipe out the count for everyone else.
 		yakkers.Del(trans.rip)
+		yaknets.Dec(yaknet)
+		trans.sess.yakker = "cleared"
 	}
 	if gotsomewhere && minphase != "message" {
 		updateTimeOf("reached_minphase", laddrstr)
@@ -1153,12 +1634,21 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 
 // Listen for new connections on a net.Listener, send the result to
 // the master.
-func listener(conn net.Listener, listenc chan net.Conn) {
+func listener(conn net.Listener, lo *listenOpts, listenc chan acceptedConn) {
 	for {
 		nc, err := conn.Accept()
 		if err == nil {
-			listenc <- nc
+			listenc <- acceptedConn{nc, lo}
+			continue
+		}
+		// Temporary errors are things like running out of file
+		// descriptors; anything else means the listener has been
+		// closed and we're done.
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			time.Sleep(10 * time.Millisecond)
+			continue
 		}
+		return
 	}
 }
 
@@ -1192,6 +1682,7 @@ var failgotdata bool
 var fromreject string
 var toaccept string
 var heloreject string
+var connrate, netconnrate, msgrate, netmsgrate string
 
 // other settings.
 var rulefiles []string
@@ -1202,6 +1693,7 @@ var savedir string
 var hashtype string
 var minphase string
 var connfile string
+var webdirs []string
 
 func openlogfile(fname string) (outf io.Writer, err error) {
 	if fname == "" {
@@ -1253,6 +1745,22 @@ func buildRules(stdrules bool) []*Rule {
 		fmt.Fprintf(&outbuf, "@from reject helo file:%s\n", heloreject)
 	}
 
+	// Rate limits. Connection rates stall at EHLO/HELO; message
+	// rates stall at MAIL FROM.
+	for _, r := range []struct{ what, rate string }{
+		{"conn", connrate}, {"netconn", netconnrate},
+		{"msg", msgrate}, {"netmsg", netmsgrate},
+	} {
+		if r.rate == "" {
+			continue
+		}
+		phase := ""
+		if r.what == "msg" || r.what == "netmsg" {
+			phase = "@from "
+		}
+		fmt.Fprintf(&outbuf, "%sstall rate %s >%s with note \"%s rate limit\" message \"Too much traffic from your network, try again later\"\n", phase, r.what, strings.TrimPrefix(r.rate, ">"), r.what)
+	}
+
 	// Parse the text into actual rules.
 	s := outbuf.String()
 	rules, err := Parse(s)
@@ -1276,6 +1784,10 @@ func genStallRules() {
 		// Should never happen.
 		die("error parsing autogenerated nil rules:\n\t%v\n", err)
 	}
+	rejectall, err = Parse("@helo reject all")
+	if err != nil || len(rejectall) == 0 {
+		die("error parsing autogenerated nil rules:\n\t%v\n", err)
+	}
 }
 
 // TODO: maybe we should use Func() and just keep a stats structure.
@@ -1285,9 +1797,19 @@ func setupExpvars() {
 	m.Init()
 	m.Set("notls", expvar.Func(notls.Stats))
 	m.Set("yakkers", expvar.Func(yakkers.Stats))
+	m.Set("yaknets", expvar.Func(yaknets.Stats))
+	m.Set("greypend", expvar.Func(greypend.Stats))
+	m.Set("greypass", expvar.Func(greypass.Stats))
+	m.Set("conns", expvar.Func(conns.Stats))
+	m.Set("rates", expvar.Func(rates.Stats))
 	stats.Set("sizes", &m)
 	stats.Set("dnsbl_hits", expvar.Func(dblcounts.Stats))
 	stats.Set("sbl_hits", expvar.Func(sblcounts.Stats))
+	var lat expvar.Map
+	lat.Init()
+	lat.Set("dns", expvar.Func(histStats(dnsTimes)))
+	lat.Set("phases", expvar.Func(histStats(phaseTimes)))
+	stats.Set("latency", &lat)
 	if manyIps {
 		stats.Set("connects_to", expvar.Func(loccounts.Stats))
 		stats.Set("lasts_to", &iptimes)
@@ -1307,6 +1829,9 @@ func setupExpvars() {
 	evts.Set("rsetdrops", &events.rsetdrops)
 	evts.Set("abandons", &events.abandons)
 	evts.Set("refuseds", &events.refuseds)
+	evts.Set("conn_limits", &events.connlimits)
+	evts.Set("proxy_errors", &events.proxyerrs)
+	evts.Set("ip_limits", &events.iplimits)
 	stats.Set("events", &evts)
 	var mailevts expvar.Map
 	var goodevts expvar.Map
@@ -1338,7 +1863,16 @@ func setupExpvars() {
 	mailevts.Set("ehlo_tlson", &events.tlson)
 	mailevts.Set("quits", &events.quits)
 	mailevts.Set("aborts", &events.aborts)
+	mailevts.Set("timeouts", &events.timeouts)
 	mailevts.Set("rsets", &events.rsets)
+	mailevts.Set("greylisted", &events.greylisted)
+	mailevts.Set("greylist_retries", &events.greyretries)
+	mailevts.Set("greylist_passed", &events.greypassed)
+	mailevts.Set("tarpits", &events.tarpits)
+	mailevts.Set("delays", &events.delays)
+	mailevts.Set("rule_drops", &events.drops)
+	mailevts.Set("discards", &events.discards)
+	mailevts.Set("quarantines", &events.quarantines)
 	stats.Set("smtpcounts", &mailevts)
 
 	// constants
@@ -1403,7 +1937,7 @@ func updateTimeOf(what, laddr string) {
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "\t%s [options] [host]:port [[host]:port ...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t%s [options] [proxy:][tls:][lmtp:]{[host]:port|unix:PATH} [...]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nOptions:\n")
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, noteStr)
@@ -1442,9 +1976,15 @@ in this process cause the connection to defer all commands with a
 `
 
 func main() {
-	var smtplogfile, logfile, dnlogfile, rfiles string
+	var smtplogfile, logfile, dnlogfile, sumlogfile, rfiles string
 	var certfile, keyfile string
-	var pprofserv string
+	var pprofserv, webserv, wdirs, adminserv string
+	var indexdir, searchq, reindex string
+	var stopwait, statesave time.Duration
+	var ipmapmax int
+	var statefile string
+	var proxytrust string
+	var runuser, rungroup, chrootdir string
 	var force, nostdrules, forcemany bool
 	var certs []tls.Certificate
 
@@ -1454,8 +1994,10 @@ func main() {
 	flag.StringVar(&srvname, "helo", "", "server `hostname` for greeting banners")
 	flag.StringVar(&smtplogfile, "smtplog", "", "log all SMTP conversations to `file`, '-' for stdout")
 	flag.StringVar(&dnlogfile, "dnlog", "", "log all do-nothing client connections to `file`, '-' for stdout")
+	flag.StringVar(&sumlogfile, "sumlog", "", "log a JSON summary of every connection to `file`, '-' for stdout")
 	flag.StringVar(&logfile, "l", "", "log summary info about received email to `file`, '-' for stdout")
 	flag.StringVar(&savedir, "d", "", "`directory` to save received messages in")
+	flag.StringVar(&quarantineDir, "quarantine", "", "`directory` to save messages from 'quarantine' rules in")
 	flag.BoolVar(&force, "force-receive", false, "force accepting email even without a -d directory")
 	flag.StringVar(&hashtype, "save-hash", "all", "`what` to base the hash name of saved messages on")
 	flag.StringVar(&certfile, "c", "", "TLS PEM certificate `file`; requires -k too")
@@ -1463,12 +2005,46 @@ func main() {
 	flag.StringVar(&fromreject, "fromreject", "", "`file` of address patterns to reject in MAIL FROMs")
 	flag.StringVar(&toaccept, "toaccept", "", "`file` of address patterns to accept in RCPT TOs")
 	flag.StringVar(&heloreject, "heloreject", "", "`file` of hostname patterns to reject in EHLOs")
+	flag.StringVar(&connrate, "connrate", "", "stall IPs that connect more than `N/DURATION`")
+	flag.StringVar(&netconnrate, "netconnrate", "", "stall /24s and /64s that connect more than `N/DURATION`")
+	flag.StringVar(&msgrate, "msgrate", "", "stall IPs that send more than `N/DURATION` messages")
+	flag.StringVar(&netmsgrate, "netmsgrate", "", "stall /24s and /64s that send more than `N/DURATION` messages")
 	flag.StringVar(&rfiles, "r", "", "comma separated list of `files` of control rules")
 	flag.IntVar(&yakCount, "dncount", 0, "stall & don't log do-nothing clients after this many `connections`")
 	flag.DurationVar(&yakTimeout, "dndur", time.Hour*8, "default do-nothing client timeout period & time window")
+	flag.DurationVar(&greyDelay, "greydelay", 5*time.Minute, "greylisting: how long clients must wait before retrying")
+	flag.DurationVar(&greyWindow, "greywindow", 24*time.Hour, "greylisting: how long after the first attempt retries are accepted")
+	flag.DurationVar(&greyLife, "greylife", 36*24*time.Hour, "greylisting: how long passed triplets are remembered after they're last seen")
+	flag.IntVar(&greyPrefix4, "greyprefix4", 24, "greylisting: group IPv4 clients into networks of this prefix `length`")
+	flag.IntVar(&greyPrefix6, "greyprefix6", 64, "greylisting: group IPv6 clients into networks of this prefix `length`")
+	flag.StringVar(&yakAction, "dnaction", "stall", "what do-nothing clients get: stall, reject, drop, tarpit, or rules")
+	flag.IntVar(&tlsFails, "tlsfails", 2, "stop offering TLS to IPs after this many TLS `failures`")
+	flag.DurationVar(&tlsTimeout, "tlsdur", time.Hour*72, "how long we remember TLS failures for")
+	flag.IntVar(&yakPrefix4, "dnprefix4", 0, "also track do-nothing clients by IPv4 networks of this prefix `length`; 0 for off")
+	flag.IntVar(&yakPrefix6, "dnprefix6", 0, "also track do-nothing clients by IPv6 networks of this prefix `length`; 0 for off")
 	flag.StringVar(&minphase, "minphase", "helo", "minimum successful `phase` to not be a do-nothing client")
 	flag.BoolVar(&nostdrules, "nostdrules", false, "do not use standard basic rules")
 	flag.StringVar(&pprofserv, "pprof", "", "`host:port` for net/http/pprof performance monitoring server")
+	flag.StringVar(&webserv, "web", "", "`host:port` for a web interface to saved messages")
+	flag.StringVar(&wdirs, "webdirs", "", "comma separated list of `directories` of saved messages for -web; defaults to -d")
+	flag.StringVar(&adminserv, "admin", "", "`host:port` for an HTTP API to the do-nothing client and TLS failure tables; only answers localhost")
+	flag.StringVar(&indexdir, "index", "", "`directory` for a full-text index of saved messages")
+	flag.StringVar(&searchq, "search", "", "search the -index for `query`, print the results, and exit")
+	flag.StringVar(&reindex, "reindex", "", "rebuild the -index from this comma separated list of save `directories` and exit")
+	flag.IntVar(&ipmapmax, "ipmapmax", 100000, "keep at most this `many` entries in each of the do-nothing client and TLS failure tables; 0 for no limit")
+	flag.StringVar(&statefile, "statefile", "", "keep the do-nothing client and TLS failure tables in `file` across restarts")
+	flag.DurationVar(&statesave, "statesave", 5*time.Minute, "how `often` to save the -statefile")
+	flag.DurationVar(&stopwait, "stopwait", 30*time.Second, "on SIGTERM or SIGINT, wait this `long` for sessions to finish")
+	flag.StringVar(&runuser, "user", "", "`user` to run as after binding our listening sockets")
+	flag.StringVar(&rungroup, "group", "", "`group` to run as after binding our listening sockets; defaults to -user's group")
+	flag.StringVar(&chrootdir, "chroot", "", "`directory` to chroot to before switching to -user")
+	flag.IntVar(&maxConns, "maxconns", 0, "refuse connections when there are already this `many`; 0 for no limit")
+	flag.IntVar(&maxPerIP, "maxperip", 0, "refuse connections when there are already this `many` from the same IP; 0 for no limit")
+	flag.BoolVar(&limitDrop, "limitdrop", false, "close connections over -maxconns or -maxperip without a 421")
+	flag.DurationVar(&cmdTimeout, "cmdtimeout", 0, "close sessions that don't send a command for this `long`; 0 for the smtpd default")
+	flag.DurationVar(&dataTimeout, "datatimeout", 0, "close sessions that take longer than this `long` to send a message; 0 for the smtpd default")
+	flag.DurationVar(&maxSession, "maxsession", 0, "close sessions that last longer than this `long`; 0 for no limit")
+	flag.StringVar(&proxytrust, "proxytrust", "", "comma separated list of `IPs and CIDRs` that may connect to proxy: listeners")
 	flag.StringVar(&connfile, "conncfg", "", "`file` of per-connection parameters")
 	// TODO: this is badly described.
 	flag.BoolVar(&forcemany, "statsperip", false, "keep additional per-local-address connection stats")
@@ -1476,9 +2052,13 @@ func main() {
 	flag.Usage = usage
 
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if searchq != "" || reindex != "" {
+		indexCommand(indexdir, searchq, reindex)
+		return
+	}
+	if flag.NArg() == 0 && !socketActivated() && !upgrading() {
 		fmt.Fprintf(os.Stderr, "%s: no arguments given about what to listen on\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "usage: %s [options] [host]:port [[host]:port ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s [options] [proxy:][tls:][lmtp:]{[host]:port|unix:PATH} [...]\n", os.Args[0])
 		return
 	}
 	// This is theoretically too pessimistic in the face of a rules file,
@@ -1503,6 +2083,69 @@ func main() {
 	if dnlogfile != "" && yakCount == 0 {
 		die("-dnlog requires -dncount")
 	}
+	if yakActions[yakAction] == "" {
+		die("bad option for -dnaction: '%s'. Only stall, reject, drop, tarpit, and rules are valid.\n", yakAction)
+	}
+	if tlsFails < 1 {
+		die("-tlsfails must be at least 1\n")
+	}
+	if tlsTimeout < time.Second {
+		die("-tlsdur is too small; must be at least one second\n")
+	}
+	for _, r := range []string{connrate, netconnrate, msgrate, netmsgrate} {
+		if _, err := parseRate(r); r != "" && err != nil {
+			die("%s\n", err)
+		}
+	}
+	if statefile != "" && statesave <= 0 {
+		die("-statesave must be positive\n")
+	}
+	if ipmapmax < 0 {
+		die("-ipmapmax cannot be negative\n")
+	}
+	for _, m := range []*ipMap{yakkers, yaknets, notls, greypend, greypass} {
+		m.max = ipmapmax
+	}
+	if yakPrefix4 < 0 || yakPrefix4 > 32 || yakPrefix6 < 0 || yakPrefix6 > 128 {
+		die("-dnprefix4 must be between 0 and 32 and -dnprefix6 between 0 and 128\n")
+	}
+	if greyDelay < 0 || greyWindow <= greyDelay || greyLife <= 0 {
+		die("-greywindow must be longer than -greydelay and -greylife must be positive\n")
+	}
+	if greyPrefix4 < 1 || greyPrefix4 > 32 || greyPrefix6 < 1 || greyPrefix6 > 128 {
+		die("-greyprefix4 must be between 1 and 32 and -greyprefix6 between 1 and 128\n")
+	}
+	if cmdTimeout < 0 || dataTimeout < 0 || maxSession < 0 {
+		die("-cmdtimeout, -datatimeout, and -maxsession cannot be negative\n")
+	}
+	var largs []string
+	var lopts []*listenOpts
+	useproxy, usetls := false, false
+	for _, a := range flag.Args() {
+		addr, lo, err := parseListenArg(a)
+		if err != nil {
+			die("%s\n", err)
+		}
+		largs = append(largs, addr)
+		lopts = append(lopts, lo)
+		useproxy = useproxy || (lo.proxy && !lo.unix)
+		usetls = usetls || lo.tls
+	}
+	var err error
+	if proxyTrust, err = parseProxyTrust(proxytrust); err != nil {
+		die("%s\n", err)
+	}
+	if useproxy && len(proxyTrust) == 0 {
+		die("proxy: listeners require -proxytrust\n")
+	}
+	if usetls && certfile == "" && connfile == "" {
+		die("tls: listeners require -c and -k or -conncfg\n")
+	}
+
+	privs, perr := lookupPrivs(runuser, rungroup, chrootdir)
+	if perr != nil {
+		die("%s\n", perr)
+	}
 
 	switch {
 	case certfile != "" && keyfile != "":
@@ -1530,6 +2173,42 @@ func main() {
 	if err != nil {
 		die("Error opening do-nothing client log file '%s': %v\n", dnlogfile, err)
 	}
+	sumlogf, err := openlogfile(sumlogfile)
+	if err != nil {
+		die("error opening session summary log file '%s': %v\n", sumlogfile, err)
+	}
+
+	// Bind our listening sockets now, so that we can drop privileges
+	// before we do anything else. If we're a new process started by
+	// an upgrade, our old process has already set up all of the
+	// listeners for us. Otherwise we may have some from systemd as
+	// well as our arguments.
+	listeners := upgradeListeners()
+	upgraded := listeners != nil
+	if !upgraded {
+		listeners = systemdListeners()
+		for i, a := range largs {
+			conn, err := listen(a, lopts[i])
+			if err != nil {
+				die("error listening to %s!%s: %s\n", lopts[i].network(), a, err)
+			}
+			listeners = append(listeners, conn)
+		}
+	}
+	if len(listeners) == 0 {
+		die("no listening sockets from systemd and no arguments\n")
+	}
+	// Our arguments' listeners come after any from systemd, both
+	// here and when they're passed to us by an upgrade.
+	for len(lopts) < len(listeners) {
+		lopts = append([]*listenOpts{{}}, lopts...)
+	}
+	lopts = lopts[len(lopts)-len(listeners):]
+	if privs != nil {
+		if err := privs.drop(); err != nil {
+			die("cannot drop privileges: %s\n", err)
+		}
+	}
 
 	// Save a lot of explosive problems by testing if we can actually
 	// use the savedir right now, *before* we start doing stuff.
@@ -1543,6 +2222,18 @@ func main() {
 		os.Remove(tstfile)
 	}
 
+	// After an upgrade our old process has already given us its
+	// state, which is newer than the state file.
+	if statefile != "" && !upgraded {
+		cnt, err := loadState(statefile)
+		if err != nil {
+			die("cannot load state file '%s': %s\n", statefile, err)
+		}
+		if cnt > 0 {
+			warnf("loaded %d yakker/notls entries from '%s'\n", cnt, statefile)
+		}
+	}
+
 	if connfile != "" {
 		_, err := loadConnFile(connfile)
 		if err != nil {
@@ -1597,6 +2288,7 @@ func main() {
 	if pprofserv != "" {
 		runtime.MemProfileRate = 1
 		setupExpvars()
+		http.HandleFunc("/events", eventsHandler)
 		go func() {
 			// TODO: Figure out what to do if this errors
 			// out. Should we die?
@@ -1607,17 +2299,51 @@ func main() {
 		}()
 	}
 
+	if adminserv != "" {
+		startAdmin(adminserv)
+	}
+
+	if indexdir != "" {
+		if savedir == "" {
+			die("-index requires -d\n")
+		}
+		ftidx, err = openFTIndex(indexdir)
+		if err != nil {
+			die("error opening index %s: %s\n", indexdir, err)
+		}
+	}
+
+	if webserv != "" {
+		switch {
+		case wdirs != "":
+			webdirs = strings.Split(wdirs, ",")
+		case savedir != "":
+			webdirs = []string{savedir}
+		default:
+			die("-web requires -d or -webdirs\n")
+		}
+		startWeb(webserv, webdirs)
+	}
+
 	// Set up a pool of listeners, one per address that we're supposed
 	// to be listening on. These are goroutines that multiplex back to
 	// us on listenc.
-	listenc := make(chan net.Conn)
-	for i := 0; i < flag.NArg(); i++ {
-		conn, err := net.Listen("tcp", flag.Arg(i))
-		if err != nil {
-			die("error listening to tcp!%s: %s\n", flag.Arg(i), err)
-		}
-		go listener(conn, listenc)
+	listenc := make(chan acceptedConn)
+	for i, l := range listeners {
+		go listener(l, lopts[i], listenc)
 	}
+	if upgraded {
+		upgradeReady(len(listeners))
+	}
+	sdReady(upgraded)
+	sdWatchdog(upgraded)
+	if statefile != "" {
+		go stateSaver(statefile, statesave)
+	}
+	go ipMapSweeper()
+
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt, syscall.SIGUSR2)
 
 	// Loop around getting new connections from our listeners and
 	// handing them off to be processed. We insist on sitting in
@@ -1626,10 +2352,57 @@ func main() {
 	// a semi-unique ID for each conversation.
 	cid := 1
 	for {
-		nc := <-listenc
-		events.connections.Add(1)
-		updateTimeOf("connection", nc.LocalAddr().String())
-		go process(cid, nc, certs, logf, slogf, dnlogf, baserules)
-		cid++
+		select {
+		case ac := <-listenc:
+			events.connections.Add(1)
+			updateTimeOf("connection", ac.nc.LocalAddr().String())
+			go process(cid, ac.nc, ac.lo, certs, logf, slogf, dnlogf, sumlogf, baserules)
+			cid++
+		case sig := <-sigc:
+			drain := false
+			if sig == syscall.SIGUSR2 {
+				if err := startUpgrade(listeners); err != nil {
+					warnf("upgrade failed: %s\n", err)
+					continue
+				}
+				warnf("upgrade started, draining sessions\n")
+				drain = true
+			} else {
+				warnf("shutting down on %s\n", sig)
+				sdNotify("STOPPING=1")
+			}
+			close(stateStop)
+			for _, l := range listeners {
+				l.Close()
+			}
+			// Connections that were accepted just before the
+			// listeners were closed still get handled.
+			go func(cid int) {
+				for ac := range listenc {
+					go process(cid, ac.nc, ac.lo, certs, logf, slogf, dnlogf, sumlogf, baserules)
+					cid++
+				}
+			}(cid)
+			// A second signal means 'exit now'.
+			go func() {
+				<-sigc
+				die("exiting immediately\n")
+			}()
+			if !(drain && liveSessions.drain(stopwait)) && !liveSessions.shutdown(stopwait) {
+				warnf("sessions still active after %s, exiting anyways\n", stopwait)
+			}
+			if ftidx != nil {
+				ftidx.Close()
+			}
+			if statefile != "" && !drain {
+				if err := saveState(statefile); err != nil {
+					warnf("error saving state to '%s': %s\n", statefile, err)
+				}
+			}
+			for _, w := range []io.Writer{logf, slogf, dnlogf, sumlogf} {
+				syncLog(w)
+			}
+			return
+		}
 	}
 }
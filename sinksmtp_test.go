@@ -1,14 +1,19 @@
 //
 // Basic testing for file loading, which is stuck in sinksmtp.go for
-// reasons that are partly historical.
+// reasons that are partly historical, and for ipMaps.
 
 package main
 
 import (
 	"bufio"
+	"io/ioutil"
+	"net"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/siebenmann/smtpd"
 )
 
 func isPresent(a []string, p string) bool {
@@ -52,3 +57,127 @@ var present = []string{
 	"info@fbi.gov", "root@", "@example.com", "postmaster@example.org",
 	"@.barney.net",
 }
+
+func TestIPMapLimits(t *testing.T) {
+	i := &ipMap{ips: make(map[string]*ipEnt), max: 3}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		i.Add(ip, time.Hour)
+	}
+	// Using 10.0.0.1 makes 10.0.0.2 the least recently used.
+	i.Lookup("10.0.0.1", time.Hour)
+	i.Add("10.0.0.4", time.Hour)
+	if len(i.ips) != 3 || i.stats.Evicted != 1 {
+		t.Fatalf("got %d entries, %d evicted", len(i.ips), i.stats.Evicted)
+	}
+	if hit, _ := i.Lookup("10.0.0.2", time.Hour); hit {
+		t.Errorf("least recently used entry wasn't evicted")
+	}
+	if hit, _ := i.Lookup("10.0.0.1", time.Hour); !hit {
+		t.Errorf("recently used entry was evicted")
+	}
+
+	i.ips["10.0.0.3"].when = time.Now().Add(-2 * time.Hour)
+	if n := i.prune(time.Hour); n != 1 || len(i.ips) != 2 || i.lru.Len() != 2 {
+		t.Errorf("prune: removed %d, left %d entries and %d in the LRU list", n, len(i.ips), i.lru.Len())
+	}
+	i.Del("10.0.0.1")
+	if len(i.ips) != 1 || i.lru.Len() != 1 {
+		t.Errorf("Del: left %d entries and %d in the LRU list", len(i.ips), i.lru.Len())
+	}
+}
+
+func TestYakNet(t *testing.T) {
+	defer func() { yakPrefix4, yakPrefix6 = 0, 0 }()
+	if n := yakNet("192.0.2.9"); n != "" {
+		t.Errorf("yakNet with no prefixes: got '%s'", n)
+	}
+	yakPrefix4 = 24
+	for ip, n := range map[string]string{
+		"192.0.2.9":   "192.0.2.0/24",
+		"2001:db8::1": "",
+		"":            "",
+	} {
+		if r := yakNet(ip); r != n {
+			t.Errorf("yakNet(%s): got '%s', want '%s'", ip, r, n)
+		}
+	}
+	yakPrefix6 = 64
+	if n := yakNet("2001:db8::1"); n != "2001:db8::/64" {
+		t.Errorf("yakNet of IPv6: got '%s'", n)
+	}
+
+	// One client that gets somewhere only takes itself off its
+	// network's count.
+	i := &ipMap{ips: make(map[string]*ipEnt)}
+	for n := 0; n < 3; n++ {
+		i.Add("192.0.2.0/24", time.Hour)
+	}
+	i.Dec("192.0.2.0/24")
+	if _, cnt := i.Lookup("192.0.2.0/24", time.Hour); cnt != 2 {
+		t.Errorf("Dec: got count %d, want 2", cnt)
+	}
+	i.Dec("192.0.2.0/24")
+	i.Dec("192.0.2.0/24")
+	if len(i.ips) != 0 || i.lru.Len() != 0 {
+		t.Errorf("Dec to zero: left %d entries and %d in the LRU list", len(i.ips), i.lru.Len())
+	}
+}
+
+func TestReply421(t *testing.T) {
+	if r := reply421("Go away"); r != "421 Go away\r\n" {
+		t.Errorf("one line: got %q", r)
+	}
+	if r := reply421("Go\naway"); r != "421-Go\r\n421 away\r\n" {
+		t.Errorf("two lines: got %q", r)
+	}
+}
+
+// Unix domain socket connections must only match their own socket
+// path in a conncfg and never match 'ip'.
+func TestUnixNoIP(t *testing.T) {
+	d, err := readConnFile(bufio.NewReader(strings.NewReader(
+		"/run/a.sock hostname=a.example.com\n/run/b.sock hostname=b.example.com\n")))
+	if err != nil {
+		t.Fatalf("conncfg error: %s", err)
+	}
+	nc := &proxyConn{laddr: &net.UnixAddr{Name: "/run/b.sock", Net: "unix"}}
+	if pd := d.find(nc); pd == nil || pd.myname != "b.example.com" {
+		t.Errorf("/run/b.sock: got %+v", pd)
+	}
+	nc.laddr = &net.UnixAddr{Name: "/run/c.sock", Net: "unix"}
+	if pd := d.find(nc); pd != nil {
+		t.Errorf("/run/c.sock: got %+v", pd)
+	}
+	for _, cidr := range []string{"/run/a.sock", "garbage", "127.0.0.1"} {
+		if matchIp("", cidr) {
+			t.Errorf("matchIp of no IP matches '%s'", cidr)
+		}
+	}
+}
+
+// A drop after @connect must send its message as a 421, not as the
+// usual tempfail reply for the command.
+func TestDropReply(t *testing.T) {
+	rules, err := Parse("@to drop all with message \"Go\naway\"\n")
+	if err != nil {
+		t.Fatalf("rules error: %s", err)
+	}
+	client, server := net.Pipe()
+	got := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		got <- string(b)
+	}()
+	trans := &smtpTransaction{sess: &sessStats{}}
+	c := newContext(trans, rules)
+	convo := smtpd.NewConn(server, smtpd.Config{}, nil)
+	res := Decide(pRto, smtpd.EventInfo{Arg: "a@b"}, c)
+	if !decided(pRto, res, smtpd.EventInfo{Arg: "a@b"}, c, convo, "", trans) || !trans.dropped {
+		t.Fatalf("drop rule did not drop")
+	}
+	sendDrop(server, c)
+	server.Close()
+	if r := <-got; r != "421-Go\r\n421 away\r\n" {
+		t.Errorf("drop reply: got %q", r)
+	}
+}
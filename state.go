@@ -0,0 +1,90 @@
+//
+// Keeping the yakker and notls tables across restarts.
+//
+// With -statefile we write both tables to a file every -statesave
+// and when we shut down, in the same format that upgrades use to pass
+// them to the new process. We load the file when we start; entries
+// that have expired since then are dropped. The file is replaced
+// atomically, so a crash while writing it leaves the old one.
+//
+// After a SIGUSR2 upgrade the new process owns the file, so the old
+// one stops writing it.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var stateLock sync.Mutex
+var stateStop = make(chan struct{})
+
+// saveState writes the current state to fname.
+func saveState(fname string) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	f, err := ioutil.TempFile(filepath.Dir(fname), ".sinksmtp-state")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = dumpState(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// loadState loads the state in fname, if it exists, and returns how
+// many current entries there were.
+func loadState(fname string) (int, error) {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	cnt, err := loadIPMaps(f, stateMaps())
+	cnt -= yakkers.prune(yakTimeout)
+	cnt -= yaknets.prune(yakTimeout)
+	cnt -= notls.prune(tlsTimeout)
+	cnt -= greypend.prune(greyWindow)
+	cnt -= greypass.prune(greyLife)
+	return cnt, err
+}
+
+// stateSaver saves the state to fname every so often until stateStop
+// is closed.
+func stateSaver(fname string, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := saveState(fname); err != nil {
+				warnonce("error saving state to '%s': %s\n", fname, err)
+			}
+		case <-stateStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+//
+// Per-connection summary records.
+//
+// The -l log only covers received messages and the SMTP log is a raw
+// transcript, so neither is convenient for statistics about what
+// connections in general did. A summary record is a single JSON object
+// per connection, written when the connection ends.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// countConn counts the bytes that go over a connection in each
+// direction. It sits below smtpd, so for TLS sessions it counts the
+// encrypted bytes. It also notes read timeouts and enforces the
+// maximum session length; see timeouts.go.
+type countConn struct {
+	net.Conn
+	rbytes, wbytes    int64
+	timedout, expired int32
+}
+
+func (cc *countConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&cc.expired) != 0 {
+		return 0, errSessionExpired
+	}
+	n, err := cc.Conn.Read(b)
+	atomic.AddInt64(&cc.rbytes, int64(n))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		atomic.StoreInt32(&cc.timedout, 1)
+	}
+	return n, err
+}
+
+func (cc *countConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	atomic.AddInt64(&cc.wbytes, int64(n))
+	return n, err
+}
+
+type tlsSummary struct {
+	On         bool   `json:"on"`
+	Cipher     string `json:"cipher,omitempty"`
+	Proto      string `json:"proto,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	Errors     int    `json:"errors,omitempty"`
+	Blocked    bool   `json:"blocked,omitempty"`
+}
+
+// The field names here are part of the summary log format, so change
+// them with care.
+type sessSummary struct {
+	ID       string         `json:"id"`
+	Start    string         `json:"start"`
+	Duration float64        `json:"duration"`
+	Remote   string         `json:"remote"`
+	Local    string         `json:"local"`
+	RDNS     []string       `json:"rdns,omitempty"`
+	Helo     string         `json:"helo,omitempty"`
+	Phase    string         `json:"phase"`
+	Action   string         `json:"action"`
+	Rule     string         `json:"rule,omitempty"`
+	End      string         `json:"end"`
+	Timeout  string         `json:"timeout,omitempty"`
+	Yakker   string         `json:"yakker,omitempty"`
+	Greylist string         `json:"greylist,omitempty"`
+	TLS      tlsSummary     `json:"tls"`
+	Commands map[string]int `json:"commands"`
+	Messages int            `json:"messages"`
+	MsgBytes int            `json:"message_bytes"`
+	BytesIn  int64          `json:"bytes_in"`
+	BytesOut int64          `json:"bytes_out"`
+}
+
+// sessStats is the running per-session data that the summary is
+// built from, beyond what is already in smtpTransaction.
+type sessStats struct {
+	phase    Phase  // furthest phase successfully reached
+	action   Action // last result from decider()
+	rule     *Rule  // the rule responsible for action, if any
+	end      string // how the session ended
+	timeout  string // why the session timed out, if it did
+	yakker   string // what happened to the client as a yakker
+	greylist string // the last greylisting result
+	commands map[string]int
+	messages int
+	msgbytes int
+	tlserrs  int
+	notls    bool // TLS was not offered because of past failures
+}
+
+func newSessStats() *sessStats {
+	return &sessStats{phase: pConnect, action: aNoresult,
+		commands: make(map[string]int)}
+}
+
+// reached notes that a phase has been successfully reached.
+func (ss *sessStats) reached(ph Phase) {
+	if ph > ss.phase {
+		ss.phase = ph
+	}
+}
+
+// phaseName strips the leading '@' from a phase's string form.
+func phaseName(ph Phase) string {
+	s := ph.String()
+	if len(s) > 1 && s[0] == '@' {
+		return s[1:]
+	}
+	return s
+}
+
+func buildSummary(prefix string, trans *smtpTransaction, cc *countConn) *sessSummary {
+	ss := trans.sess
+	sum := &sessSummary{
+		ID:       prefix,
+		Start:    trans.timing.start.Format(TimeNZ),
+		Duration: time.Since(trans.timing.start).Seconds(),
+		Remote:   trans.raddr.String(),
+		Local:    trans.laddr.String(),
+		Helo:     trans.heloname,
+		Phase:    phaseName(ss.phase),
+		End:      ss.end,
+		Timeout:  ss.timeout,
+		Yakker:   ss.yakker,
+		Greylist: ss.greylist,
+		Commands: ss.commands,
+		Messages: ss.messages,
+		MsgBytes: ss.msgbytes,
+	}
+	if trans.rdns != nil {
+		sum.RDNS = trans.rdns.verified
+	}
+	// A no result decision is effectively an accept.
+	if ss.action == aNoresult {
+		sum.Action = aAccept.String()
+	} else {
+		sum.Action = ss.action.String()
+	}
+	if ss.rule != nil {
+		sum.Rule = ss.rule.String()
+	}
+	sum.TLS.On = trans.tlson
+	if trans.tlson {
+		sum.TLS.Cipher = cipherNames[trans.cipher]
+		sum.TLS.Proto = tlsProtoVersion(trans.tlsversion)
+		sum.TLS.ServerName = trans.servername
+	}
+	sum.TLS.Errors = ss.tlserrs
+	sum.TLS.Blocked = ss.notls
+	if cc != nil {
+		sum.BytesIn = atomic.LoadInt64(&cc.rbytes)
+		sum.BytesOut = atomic.LoadInt64(&cc.wbytes)
+	}
+	return sum
+}
+
+// logSummary writes the session summary as a single line of JSON.
+// Like logMessage(), this is done with a single Write() so that
+// simultaneous sessions don't interleave their output.
+func logSummary(sumlog io.Writer, prefix string, trans *smtpTransaction, cc *countConn) {
+	if sumlog == nil {
+		return
+	}
+	b, err := json.Marshal(buildSummary(prefix, trans, cc))
+	if err != nil {
+		warnf("error generating session summary: %s\n", err)
+		return
+	}
+	sumlog.Write(append(b, '\n'))
+}
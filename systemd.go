@@ -0,0 +1,106 @@
+//
+// systemd socket activation and service notification, done directly
+// instead of through libsystemd so that we don't need cgo.
+//
+// With socket activation systemd passes us already open listening
+// sockets starting at fd 3, with $LISTEN_FDS saying how many and
+// $LISTEN_PID saying which process they're for. Notifications are
+// datagrams like 'READY=1' sent to the unix socket in $NOTIFY_SOCKET.
+// See sd_listen_fds(3) and sd_notify(3).
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdListeners returns the listening sockets that systemd has
+// passed us, if any.
+func systemdListeners() []net.Listener {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	// These must not be passed on to any new process we start.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), fmt.Sprintf("systemd%d", i))
+		l, err := net.FileListener(f)
+		if err != nil {
+			die("systemd fd %d is not a listening socket: %s\n", 3+i, err)
+		}
+		f.Close()
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// socketActivated is true if we are supposed to get listeners from
+// systemd.
+func socketActivated() bool {
+	return os.Getenv("LISTEN_FDS") != ""
+}
+
+// sdNotify sends a notification to systemd. It does nothing if we
+// are not running under systemd.
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	// '@' means a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		warnonce("cannot talk to systemd: %s\n", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		warnonce("cannot talk to systemd: %s\n", err)
+	}
+}
+
+// sdReady tells systemd that we're ready to handle connections. After
+// an upgrade we're a new process, so we also tell systemd our PID;
+// this requires NotifyAccess=all in the unit file.
+func sdReady(upgraded bool) {
+	if upgraded {
+		sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	} else {
+		sdNotify("READY=1")
+	}
+}
+
+// sdWatchdog pings the systemd watchdog, if it's enabled, at half of
+// the watchdog interval. $WATCHDOG_PID is for our old process after
+// an upgrade, since it's inherited.
+func sdWatchdog(upgraded bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if wpid := os.Getenv("WATCHDOG_PID"); wpid != "" && !upgraded && wpid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	go func() {
+		for {
+			sdNotify("WATCHDOG=1")
+			time.Sleep(time.Duration(usec) * time.Microsecond / 2)
+		}
+	}()
+}
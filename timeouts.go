@@ -0,0 +1,92 @@
+//
+// Session timeouts: how long we wait for a command, how long a client
+// has to send us a message's DATA, and how long a whole session can
+// last. The first two are smtpd limits; the last is enforced by us
+// through countConn.
+//
+// Slow clients that run out of time get their connection closed and
+// the session counts as an abort.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/siebenmann/smtpd"
+)
+
+var cmdTimeout, dataTimeout, maxSession time.Duration
+
+var errSessionExpired = errors.New("session exceeded maximum length")
+
+// sessTimeouts are the timeouts for a single session. Zero means the
+// smtpd default for cmd and data and no limit for session.
+type sessTimeouts struct {
+	cmd, data, session time.Duration
+}
+
+// override replaces any timeouts that pd sets.
+func (st *sessTimeouts) override(pd *perDest) {
+	if pd.cmdtimeout > 0 {
+		st.cmd = pd.cmdtimeout
+	}
+	if pd.datatimeout > 0 {
+		st.data = pd.datatimeout
+	}
+	if pd.maxsession > 0 {
+		st.session = pd.maxsession
+	}
+}
+
+// limits returns the smtpd limits to use for the session, or nil if
+// the smtpd defaults are fine.
+func (st *sessTimeouts) limits() *smtpd.Limits {
+	if st.cmd == 0 && st.data == 0 {
+		return nil
+	}
+	l := smtpd.DefaultLimits
+	if st.cmd > 0 {
+		l.CmdInput = st.cmd
+	}
+	if st.data > 0 {
+		l.MsgInput = st.data
+	}
+	return &l
+}
+
+// tlsSetup is how long a client has to set up TLS.
+func (st *sessTimeouts) tlsSetup() time.Duration {
+	if l := st.limits(); l != nil {
+		return l.TLSSetup
+	}
+	return smtpd.DefaultLimits.TLSSetup
+}
+
+// reason returns why the session on cc was aborted, if it was because
+// of a timeout. indata is true if we were waiting for a message.
+func (st *sessTimeouts) reason(cc *countConn, indata bool) string {
+	l := st.limits()
+	if l == nil {
+		l = &smtpd.DefaultLimits
+	}
+	switch {
+	case atomic.LoadInt32(&cc.expired) != 0:
+		return fmt.Sprintf("session exceeded maximum length of %s", st.session)
+	case atomic.LoadInt32(&cc.timedout) == 0:
+		return ""
+	case indata:
+		return fmt.Sprintf("message transfer took longer than %s", l.MsgInput)
+	default:
+		return fmt.Sprintf("no command within %s", l.CmdInput)
+	}
+}
+
+// expire ends the session on cc. smtpd sets its own read deadlines,
+// so after this all further reads fail regardless of them.
+func (cc *countConn) expire() {
+	atomic.StoreInt32(&cc.expired, 1)
+	cc.Conn.SetReadDeadline(time.Now())
+}
@@ -0,0 +1,174 @@
+//
+// Latency tracking for DNS lookups and SMTP session phases.
+//
+// Slow DNS is the usual reason that clients time out on us, so we
+// keep global histograms of how long each sort of DNS lookup and each
+// phase of the SMTP conversation takes (exposed through expvar) and
+// a per-session breakdown that is written to the SMTP log when the
+// session ends.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histogram bucket upper bounds. Anything slower than the last bound
+// goes into a final overflow bucket.
+var histBounds = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+type histogram struct {
+	sync.Mutex
+	counts []uint64 // one per histBounds entry plus the overflow
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(histBounds)+1)}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(histBounds) && d > histBounds[i] {
+		i++
+	}
+	h.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+	h.Unlock()
+}
+
+// Stats is fed to expvar.Func(). Buckets are not cumulative; each
+// one counts only the observations that were larger than the previous
+// bound.
+func (h *histogram) Stats() interface{} {
+	h.Lock()
+	defer h.Unlock()
+	buckets := make(map[string]uint64)
+	for i, b := range histBounds {
+		buckets["le_"+b.String()] = h.counts[i]
+	}
+	buckets["inf"] = h.counts[len(histBounds)]
+	return map[string]interface{}{
+		"count":   h.count,
+		"sum_ms":  h.sum.Seconds() * 1000,
+		"max_ms":  h.max.Seconds() * 1000,
+		"buckets": buckets,
+	}
+}
+
+// What sorts of DNS lookups we time. These are fixed so that the
+// maps are read-only after startup and need no locking.
+var dnsTimes = map[string]*histogram{
+	"rdns":      newHistogram(), // LookupAddrVerified() of the remote IP
+	"localname": newHistogram(), // name of the local IP for our banner
+	"dnsbl":     newHistogram(), // dnsbl and dbl lookups
+	"domain":    newHistogram(), // ValidDomain() of addresses
+	"sbl":       newHistogram(), // SBL TXT record lookups
+}
+
+// Phase timing is how long it took us to decide about each phase
+// (including any DNS lookups that the rules needed), plus some
+// synthetic phases: 'connect' is how long until the greeting banner
+// is ready, 'transfer' is the time from DATA being accepted to the
+// message being fully received, and 'session' is the whole thing.
+var phaseTimes = map[string]*histogram{
+	"connect": newHistogram(), "helo": newHistogram(),
+	"from": newHistogram(), "to": newHistogram(),
+	"data": newHistogram(), "message": newHistogram(),
+	"transfer": newHistogram(), "session": newHistogram(),
+}
+
+// sessTiming accumulates the time spent in various things over a
+// single session. All methods work on a nil sessTiming so that
+// things like tests don't have to set one up.
+type sessTiming struct {
+	start  time.Time
+	names  []string // in order of first appearance
+	durs   map[string]time.Duration
+	counts map[string]int
+}
+
+func newSessTiming() *sessTiming {
+	return &sessTiming{start: time.Now(),
+		durs:   make(map[string]time.Duration),
+		counts: make(map[string]int),
+	}
+}
+
+func (st *sessTiming) add(what string, d time.Duration) {
+	if st == nil {
+		return
+	}
+	if _, ok := st.durs[what]; !ok {
+		st.names = append(st.names, what)
+	}
+	st.durs[what] += d
+	st.counts[what]++
+}
+
+// String gives the breakdown in a form suitable for the SMTP log.
+// Things that happened more than once have their count reported too.
+func (st *sessTiming) String() string {
+	if st == nil {
+		return ""
+	}
+	l := []string{"total " + roundDur(time.Since(st.start))}
+	for _, n := range st.names {
+		s := n + " " + roundDur(st.durs[n])
+		if st.counts[n] > 1 {
+			s += fmt.Sprintf("/%d", st.counts[n])
+		}
+		l = append(l, s)
+	}
+	return strings.Join(l, " ")
+}
+
+func roundDur(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+// noteDNS records a DNS lookup of type what that started at start.
+func noteDNS(trans *smtpTransaction, what string, start time.Time) {
+	d := time.Since(start)
+	dnsTimes[what].Observe(d)
+	if trans != nil {
+		trans.timing.add(what, d)
+	}
+}
+
+// notePhase records the time taken by a (possibly synthetic) phase.
+func notePhase(trans *smtpTransaction, what string, start time.Time) {
+	d := time.Since(start)
+	phaseTimes[what].Observe(d)
+	if trans != nil {
+		trans.timing.add(what, d)
+	}
+}
+
+// This is a hack. We feed this to expvar.Func() so that the set of
+// histograms appears as a single map.
+func histStats(hm map[string]*histogram) func() interface{} {
+	return func() interface{} {
+		m := make(map[string]interface{})
+		for k, h := range hm {
+			m[k] = h.Stats()
+		}
+		return m
+	}
+}
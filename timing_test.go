@@ -0,0 +1,46 @@
+//
+// Test the latency histogram and per-session timing support.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.Observe(0)
+	h.Observe(time.Millisecond)
+	h.Observe(3 * time.Millisecond)
+	h.Observe(time.Hour)
+	if h.count != 4 {
+		t.Fatalf("wrong count: %d", h.count)
+	}
+	if h.counts[0] != 2 || h.counts[1] != 1 || h.counts[len(histBounds)] != 1 {
+		t.Fatalf("wrong bucket counts: %v", h.counts)
+	}
+	if h.max != time.Hour {
+		t.Fatalf("wrong max: %v", h.max)
+	}
+}
+
+func TestSessTiming(t *testing.T) {
+	var nst *sessTiming
+	// must not explode.
+	nst.add("rdns", time.Second)
+	if nst.String() != "" {
+		t.Fatalf("nil sessTiming has a string: '%s'", nst.String())
+	}
+
+	st := newSessTiming()
+	st.add("rdns", 10*time.Millisecond)
+	st.add("dnsbl", time.Millisecond)
+	st.add("dnsbl", 2*time.Millisecond)
+	st.start = time.Now()
+	s := st.String()
+	exp := "total 0s rdns 10ms dnsbl 3ms/2"
+	if s != exp {
+		t.Fatalf("wrong timing string: '%s' instead of '%s'", s, exp)
+	}
+}
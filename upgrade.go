@@ -0,0 +1,253 @@
+//
+// Zero-downtime upgrades.
+//
+// On SIGUSR2 we start a new copy of ourselves (from the current
+// executable, with the same arguments) and pass it our listening
+// sockets as inherited file descriptors, plus our yakker and notls
+// state. Once the new process says that it's ready we stop accepting
+// connections and let our current sessions finish on their own for up
+// to -stopwait, after which we shut down as if we had gotten a
+// SIGTERM. If the new process doesn't start or doesn't become ready,
+// we kill it and carry on as before.
+//
+// The new process takes all of its listeners from us, including any
+// that we got from systemd, instead of using its arguments. It gets:
+//	fd 3 .. 3+N-1	all of our listening sockets
+//	fd 3+N		a pipe that the ipMap state is written to
+//	fd 3+N+1	a pipe that it writes 'ready' to once it's running
+// and $SINKSMTP_UPGRADE set to N.
+//
+// Yakker and notls changes made by the old process while it drains
+// are not passed on.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const upgradeEnv = "SINKSMTP_UPGRADE"
+
+// How long we wait for the new process to become ready.
+const upgradeWait = 30 * time.Second
+
+// dump writes out all of the current entries in an ipMap as lines of
+// 'NAME IP UNIX-TIME COUNT'. Expired entries are skipped. Writing
+// to w may block (it's often a pipe), so we copy the entries and
+// write them out after we've unlocked the map.
+func (i *ipMap) dump(w io.Writer, name string, ttl time.Duration) error {
+	var lines []string
+	i.Lock()
+	for ip, t := range i.ips {
+		if time.Since(t.when) >= ttl {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d %d\n", name, ip, t.when.Unix(), t.count))
+	}
+	i.Unlock()
+	for _, l := range lines {
+		if _, err := io.WriteString(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIPMaps reads ipMap entries in the format written by dump() into
+// the maps in mps, which are indexed by name. It returns how many
+// entries were loaded. Bad lines and unknown names are skipped.
+func loadIPMaps(r io.Reader, mps map[string]*ipMap) (int, error) {
+	cnt := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 4 || mps[f[0]] == nil {
+			continue
+		}
+		// yaknets entries are networks, not IPs, and greylisting
+		// entries start with a network.
+		key := f[1]
+		if i := strings.IndexByte(key, ','); i >= 0 {
+			key = key[:i]
+		}
+		if _, _, err := net.ParseCIDR(key); net.ParseIP(key) == nil && err != nil {
+			continue
+		}
+		when, err1 := strconv.ParseInt(f[2], 10, 64)
+		count, err2 := strconv.Atoi(f[3])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		i := mps[f[0]]
+		i.Lock()
+		i.insert(f[1], &ipEnt{when: time.Unix(when, 0), count: count})
+		i.Unlock()
+		cnt++
+	}
+	return cnt, scanner.Err()
+}
+
+func stateMaps() map[string]*ipMap {
+	return map[string]*ipMap{"yakkers": yakkers, "yaknets": yaknets, "notls": notls,
+		"greypend": greypend, "greypass": greypass}
+}
+
+func dumpState(w io.Writer) error {
+	if err := yakkers.dump(w, "yakkers", yakTimeout); err != nil {
+		return err
+	}
+	if err := yaknets.dump(w, "yaknets", yakTimeout); err != nil {
+		return err
+	}
+	if err := notls.dump(w, "notls", tlsTimeout); err != nil {
+		return err
+	}
+	if err := greypend.dump(w, "greypend", greyWindow); err != nil {
+		return err
+	}
+	return greypass.dump(w, "greypass", greyLife)
+}
+
+// startUpgrade starts a new sinksmtp and waits for it to become
+// ready. Once it is, Unix domain sockets are no longer removed when
+// we close our listeners, since they're now the new process's.
+func startUpgrade(listeners []net.Listener) error {
+	if chrooted != "" {
+		return fmt.Errorf("cannot upgrade when chrooted to %s", chrooted)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("cannot pass on listener for %s", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	stater, statew, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	files = append(files, stater)
+	readyr, readyw, err := os.Pipe()
+	if err != nil {
+		statew.Close()
+		return err
+	}
+	defer readyr.Close()
+	files = append(files, readyw)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", upgradeEnv, len(listeners)))
+	if err = cmd.Start(); err != nil {
+		statew.Close()
+		return err
+	}
+	// Our copies of the child's ends must be closed so that we see
+	// EOF on the ready pipe if it dies.
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	err = dumpState(statew)
+	statew.Close()
+	if err != nil {
+		warnf("upgrade: error passing on state: %s\n", err)
+	}
+
+	readyc := make(chan bool, 1)
+	go func() {
+		line, _ := bufio.NewReader(readyr).ReadString('\n')
+		readyc <- line == "ready\n"
+	}()
+	select {
+	case ok := <-readyc:
+		if ok {
+			go cmd.Wait()
+			for _, l := range listeners {
+				if ul, ok := l.(*net.UnixListener); ok {
+					ul.SetUnlinkOnClose(false)
+				}
+			}
+			return nil
+		}
+		err = fmt.Errorf("new process exited without becoming ready")
+	case <-time.After(upgradeWait):
+		err = fmt.Errorf("new process not ready after %s", upgradeWait)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return err
+}
+
+// upgradeListeners returns the listeners passed to us by our old
+// process, or nil if we aren't being started as an upgrade. It also
+// loads the state that was passed to us.
+func upgradeListeners() []net.Listener {
+	ev := os.Getenv(upgradeEnv)
+	if ev == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+	n, err := strconv.Atoi(ev)
+	if err != nil || n <= 0 {
+		die("upgrade: bad $%s: '%s'\n", upgradeEnv, ev)
+	}
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), fmt.Sprintf("listener%d", i))
+		l, err := net.FileListener(f)
+		if err != nil {
+			die("upgrade: bad listener fd %d: %s\n", 3+i, err)
+		}
+		f.Close()
+		listeners = append(listeners, l)
+	}
+	statef := os.NewFile(uintptr(3+n), "state")
+	cnt, err := loadIPMaps(statef, stateMaps())
+	statef.Close()
+	if err != nil {
+		warnf("upgrade: error reading state: %s\n", err)
+	}
+	warnf("upgrade: took over %d listeners and %d yakker/notls entries\n", n, cnt)
+	return listeners
+}
+
+// upgradeReady tells the old process that we're running.
+func upgradeReady(listeners int) {
+	f := os.NewFile(uintptr(3+listeners+1), "ready")
+	f.Write([]byte("ready\n"))
+	f.Close()
+}
+
+// upgrading is true if we are being started by an upgrade.
+func upgrading() bool {
+	return os.Getenv(upgradeEnv) != ""
+}
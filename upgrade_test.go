@@ -0,0 +1,92 @@
+//
+// Test passing ipMap state between processes and through the state
+// file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPMapState(t *testing.T) {
+	src := &ipMap{ips: make(map[string]*ipEnt)}
+	src.Add("192.168.10.3", time.Hour)
+	src.Add("192.168.10.3", time.Hour)
+	src.Add("::1", time.Hour)
+	src.ips["10.0.0.1"] = &ipEnt{when: time.Now().Add(-2 * time.Hour), count: 10}
+
+	var buf bytes.Buffer
+	if err := src.dump(&buf, "yakkers", time.Hour); err != nil {
+		t.Fatalf("dump: %s", err)
+	}
+	// junk should be skipped.
+	buf.WriteString("notls 1.2.3.4 100 1\nyakkers bad 100 1\nyakkers 1.2.3.4 x 1\n")
+
+	dst := &ipMap{ips: make(map[string]*ipEnt)}
+	cnt, err := loadIPMaps(strings.NewReader(buf.String()), map[string]*ipMap{"yakkers": dst})
+	if err != nil || cnt != 2 {
+		t.Fatalf("load: %d entries, err %v", cnt, err)
+	}
+	if hit, n := dst.Lookup("192.168.10.3", time.Hour); !hit || n != 2 {
+		t.Errorf("192.168.10.3: got %v %d", hit, n)
+	}
+	if hit, n := dst.Lookup("::1", time.Hour); !hit || n != 1 {
+		t.Errorf("::1: got %v %d", hit, n)
+	}
+	if hit, _ := dst.Lookup("10.0.0.1", time.Hour); hit {
+		t.Errorf("expired entry was passed on")
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinksmtp-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "state")
+	defer func() {
+		yakkers.ips = make(map[string]*ipEnt)
+		notls.ips = make(map[string]*ipEnt)
+	}()
+
+	if cnt, err := loadState(fname); cnt != 0 || err != nil {
+		t.Fatalf("missing state file: %d entries, err %v", cnt, err)
+	}
+	yakkers.Set("192.168.10.3", yakTimeout, 4)
+	notls.Add("::1", tlsTimeout)
+	if err := saveState(fname); err != nil {
+		t.Fatalf("saveState: %s", err)
+	}
+	// An entry that expires between saving and loading is dropped.
+	f, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("yakkers 10.0.0.1 1 5\n")
+	f.Close()
+
+	yakkers.ips = make(map[string]*ipEnt)
+	notls.ips = make(map[string]*ipEnt)
+	if cnt, err := loadState(fname); cnt != 2 || err != nil {
+		t.Fatalf("loadState: %d entries, err %v", cnt, err)
+	}
+	if hit, n := yakkers.Lookup("192.168.10.3", yakTimeout); !hit || n != 4 {
+		t.Errorf("yakker: got %v %d", hit, n)
+	}
+	if hit, n := notls.Lookup("::1", tlsTimeout); !hit || n != 1 {
+		t.Errorf("notls: got %v %d", hit, n)
+	}
+	if len(yakkers.ips) != 1 {
+		t.Errorf("expired entry was loaded")
+	}
+	if fs, _ := ioutil.ReadDir(dir); len(fs) != 1 {
+		t.Errorf("temporary files left behind: %d files", len(fs))
+	}
+}
@@ -0,0 +1,475 @@
+//
+// An optional web interface and JSON API for browsing saved messages.
+//
+// We keep an in-memory index of the metadata of every saved message
+// in the -webdirs directories (by default the -d directory), built by
+// scanning them at startup and then added to as handleMessage() saves
+// new messages. Message bodies are read from disk when they are looked
+// at.
+//
+// Endpoints:
+//	/			HTML list of messages with a search form
+//	/msg/NAME		HTML view of a message's metadata, headers,
+//				and MIME parts
+//	/raw/NAME		the raw message, as text/plain
+//	/api/messages		JSON list of messages
+//	/api/messages/NAME	JSON metadata, headers, and MIME parts
+//
+// Messages are identified by their directory as well as their name,
+// since the same message can be saved in several directories. NAME
+// takes a 'dir' query parameter, which defaults to the first -webdirs
+// directory.
+//
+// Lists take the query parameters from, to (case-independent
+// substring matches), ip (IP or CIDR), hash (a prefix of the file
+// name, message hash, or body hash), since and until (YYYY-MM-DD),
+// and limit. They are newest first.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type msgIndex struct {
+	sync.Mutex
+	msgs   []*savedMsg // in the order they were added
+	names  map[msgKey]*savedMsg
+	defdir string // for lookups without a directory
+}
+
+type msgKey struct {
+	dir, name string
+}
+
+// webIndex is nil unless -web is in use.
+var webIndex *msgIndex
+
+func newMsgIndex() *msgIndex {
+	return &msgIndex{names: make(map[msgKey]*savedMsg)}
+}
+
+func (mi *msgIndex) add(sm *savedMsg) {
+	k := msgKey{sm.Dir, sm.Name}
+	mi.Lock()
+	if mi.names[k] == nil {
+		mi.msgs = append(mi.msgs, sm)
+		mi.names[k] = sm
+	}
+	mi.Unlock()
+}
+
+// get returns the message name in dir, or in our default directory
+// if dir is "".
+func (mi *msgIndex) get(dir, name string) *savedMsg {
+	mi.Lock()
+	defer mi.Unlock()
+	if dir == "" {
+		dir = mi.defdir
+	}
+	return mi.names[msgKey{dir, name}]
+}
+
+type msgQuery struct {
+	from, to, ip, hash string
+	since, until       time.Time
+}
+
+func (q *msgQuery) matches(sm *savedMsg) bool {
+	if q.from != "" && !strings.Contains(strings.ToLower(sm.From), q.from) {
+		return false
+	}
+	if q.to != "" {
+		found := false
+		for _, t := range sm.To {
+			if strings.Contains(strings.ToLower(t), q.to) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.ip != "" && !matchIp(sm.Remote, q.ip) {
+		return false
+	}
+	if q.hash != "" && !(strings.HasPrefix(sm.Name, q.hash) || strings.HasPrefix(sm.Hash, q.hash) || strings.HasPrefix(sm.BodyHash, q.hash)) {
+		return false
+	}
+	if !q.since.IsZero() && sm.When.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !sm.When.Before(q.until) {
+		return false
+	}
+	return true
+}
+
+// search returns up to limit matching messages, newest first.
+func (mi *msgIndex) search(q *msgQuery, limit int) []*savedMsg {
+	var res []*savedMsg
+	mi.Lock()
+	for _, sm := range mi.msgs {
+		if q.matches(sm) {
+			res = append(res, sm)
+		}
+	}
+	mi.Unlock()
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].When.After(res[j].When)
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+// Parse list query parameters. Bad dates are an error; a bad limit
+// just gets the default.
+func parseMsgQuery(r *http.Request) (*msgQuery, int, error) {
+	var err error
+	v := r.URL.Query()
+	q := &msgQuery{from: strings.ToLower(v.Get("from")),
+		to: strings.ToLower(v.Get("to")), ip: v.Get("ip"),
+		hash: strings.ToLower(v.Get("hash"))}
+	if q.ip != "" && !validIPArg(q.ip) {
+		return nil, 0, errBadQuery("ip must be an IP address or CIDR")
+	}
+	if s := v.Get("since"); s != "" {
+		q.since, err = time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return nil, 0, errBadQuery("bad since date")
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		q.until, err = time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return nil, 0, errBadQuery("bad until date")
+		}
+		// until is inclusive.
+		q.until = q.until.AddDate(0, 0, 1)
+	}
+	limit := 100
+	if n, err := strconv.Atoi(v.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	return q, limit, nil
+}
+
+type errBadQuery string
+
+func (e errBadQuery) Error() string {
+	return string(e)
+}
+
+// ----
+// Taking messages apart for display.
+
+type msgHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// rawHeaders returns the message headers in order, unfolded and with
+// RFC 2047 encoded words decoded if possible. net/mail gives us a map,
+// which loses the order.
+func rawHeaders(raw []byte) []msgHeader {
+	var hdrs []msgHeader
+	var dec mime.WordDecoder
+	rdr := bufio.NewReader(bytes.NewReader(raw))
+	for {
+		line, err := rdr.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(hdrs) > 0 {
+			hdrs[len(hdrs)-1].Value += " " + strings.TrimSpace(line)
+		} else if idx := strings.IndexByte(line, ':'); idx > 0 {
+			hdrs = append(hdrs, msgHeader{Name: line[:idx],
+				Value: strings.TrimSpace(line[idx+1:])})
+		}
+		if err != nil {
+			break
+		}
+	}
+	for i := range hdrs {
+		if d, err := dec.DecodeHeader(hdrs[i].Value); err == nil {
+			hdrs[i].Value = d
+		}
+	}
+	return hdrs
+}
+
+type msgPart struct {
+	Path        string `json:"path"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int    `json:"size"`
+	Text        string `json:"text,omitempty"`
+}
+
+// We only show this much of each text part.
+const maxPartText = 64 * 1024
+
+// mimeParts walks the MIME structure of something with headers hdr
+// and content body, appending leaf parts to parts. Paths are '1',
+// '1.2', and so on.
+func mimeParts(hdr textproto.MIMEHeader, body io.Reader, path string, parts []msgPart) []msgPart {
+	ct := hdr.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mt = "application/octet-stream"
+	}
+	if strings.HasPrefix(mt, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			parts = mimeParts(p.Header, p, path+"."+strconv.Itoa(i), parts)
+		}
+		return parts
+	}
+
+	// multipart.Reader removes the Content-Transfer-Encoding for
+	// quoted-printable parts itself, but not for base64 ones and not
+	// at the top level.
+	switch strings.ToLower(hdr.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, _ := ioutil.ReadAll(body)
+	part := msgPart{Path: strings.TrimPrefix(path, "."), ContentType: mt,
+		Size: len(data)}
+	if part.Path == "" {
+		part.Path = "1"
+	}
+	if _, dp, err := mime.ParseMediaType(hdr.Get("Content-Disposition")); err == nil && dp["filename"] != "" {
+		part.Filename = dp["filename"]
+	} else if params["name"] != "" {
+		part.Filename = params["name"]
+	}
+	if strings.HasPrefix(mt, "text/") {
+		if len(data) > maxPartText {
+			data = data[:maxPartText]
+		}
+		part.Text = string(data)
+	}
+	return append(parts, part)
+}
+
+type msgDetail struct {
+	*savedMsg
+	Headers []msgHeader `json:"headers"`
+	Parts   []msgPart   `json:"parts"`
+}
+
+func loadMsgDetail(sm *savedMsg) (*msgDetail, []byte, error) {
+	_, raw, err := readSaved(sm.Dir, sm.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	md := &msgDetail{savedMsg: sm, Headers: rawHeaders(raw)}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err == nil {
+		md.Parts = mimeParts(textproto.MIMEHeader(msg.Header), msg.Body, "", nil)
+	}
+	return md, raw, nil
+}
+
+// ----
+// HTTP handlers.
+
+func webMsgFor(w http.ResponseWriter, r *http.Request, pref string) *savedMsg {
+	name := strings.TrimPrefix(r.URL.Path, pref)
+	sm := webIndex.get(r.FormValue("dir"), name)
+	if sm == nil {
+		http.NotFound(w, r)
+	}
+	return sm
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func apiListHandler(w http.ResponseWriter, r *http.Request) {
+	q, limit, err := parseMsgQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := webIndex.search(q, limit)
+	if res == nil {
+		res = []*savedMsg{}
+	}
+	writeJSON(w, res)
+}
+
+func apiMsgHandler(w http.ResponseWriter, r *http.Request) {
+	sm := webMsgFor(w, r, "/api/messages/")
+	if sm == nil {
+		return
+	}
+	md, _, err := loadMsgDetail(sm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, md)
+}
+
+func rawMsgHandler(w http.ResponseWriter, r *http.Request) {
+	sm := webMsgFor(w, r, "/raw/")
+	if sm == nil {
+		return
+	}
+	_, raw, err := readSaved(sm.Dir, sm.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(raw)
+}
+
+func htmlMsgHandler(w http.ResponseWriter, r *http.Request) {
+	sm := webMsgFor(w, r, "/msg/")
+	if sm == nil {
+		return
+	}
+	md, _, err := loadMsgDetail(sm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msgTmpl.Execute(w, md)
+}
+
+func htmlListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	q, limit, err := parseMsgQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	listTmpl.Execute(w, struct {
+		Q    map[string]string
+		Msgs []*savedMsg
+	}{
+		Q: map[string]string{"from": r.FormValue("from"),
+			"to": r.FormValue("to"), "ip": r.FormValue("ip"),
+			"hash": r.FormValue("hash"), "since": r.FormValue("since"),
+			"until": r.FormValue("until")},
+		Msgs: webIndex.search(q, limit),
+	})
+}
+
+// startWeb sets up the message index and starts the web server. The
+// initial scan of the save directories happens in the background,
+// since it may take a while.
+func startWeb(hostport string, dirs []string) {
+	webIndex = newMsgIndex()
+	webIndex.defdir = dirs[0]
+	go func() {
+		for _, d := range dirs {
+			if err := scanSaveDir(d, webIndex.add); err != nil {
+				warnf("web: error scanning %s: %s\n", d, err)
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", htmlListHandler)
+	mux.HandleFunc("/msg/", htmlMsgHandler)
+	mux.HandleFunc("/raw/", rawMsgHandler)
+	mux.HandleFunc("/api/messages", apiListHandler)
+	mux.HandleFunc("/api/messages/", apiMsgHandler)
+	if ftidx != nil {
+		mux.HandleFunc("/api/search", apiSearchHandler)
+	}
+	go func() {
+		e := http.ListenAndServe(hostport, mux)
+		if e != nil {
+			die("web HTTP server failed: %s\n", e)
+		}
+	}()
+}
+
+var listTmpl = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html><head><title>sinksmtp messages</title></head><body>
+<form method="get" action="/">
+from <input name="from" value="{{.Q.from}}">
+to <input name="to" value="{{.Q.to}}">
+ip <input name="ip" value="{{.Q.ip}}">
+hash <input name="hash" value="{{.Q.hash}}">
+since <input name="since" value="{{.Q.since}}" placeholder="YYYY-MM-DD">
+until <input name="until" value="{{.Q.until}}" placeholder="YYYY-MM-DD">
+<input type="submit" value="search">
+</form>
+<table border="1" cellpadding="3">
+<tr><th>when</th><th>from</th><th>to</th><th>remote</th><th>helo</th><th>bytes</th></tr>
+{{range .Msgs}}<tr><td><a href="/msg/{{.Name}}?dir={{.Dir}}">{{.When.Format "2006-01-02 15:04:05"}}</a></td>
+<td>&lt;{{.From}}&gt;</td><td>{{range .To}}&lt;{{.}}&gt; {{end}}</td>
+<td>{{.Remote}}</td><td>{{.Helo}}</td><td>{{.Bytes}}</td></tr>
+{{else}}<tr><td colspan="6">no messages</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+var msgTmpl = template.Must(template.New("msg").Parse(`<!DOCTYPE html>
+<html><head><title>sinksmtp message {{.Name}}</title></head><body>
+<p><a href="/">all messages</a> | <a href="/raw/{{.Name}}?dir={{.Dir}}">raw source</a></p>
+<table border="1" cellpadding="3">
+<tr><th>id</th><td>{{.ID}}</td></tr>
+<tr><th>when</th><td>{{.When.Format "2006-01-02 15:04:05"}}</td></tr>
+<tr><th>remote</th><td>{{.Remote}} {{range .RDNS}}{{.}} {{end}}</td></tr>
+<tr><th>local</th><td>{{.Local}}</td></tr>
+<tr><th>helo</th><td>{{.Helo}}</td></tr>
+<tr><th>tls</th><td>{{.TLS}}</td></tr>
+<tr><th>from</th><td>&lt;{{.From}}&gt;</td></tr>
+<tr><th>to</th><td>{{range .To}}&lt;{{.}}&gt; {{end}}</td></tr>
+<tr><th>hash</th><td>{{.Hash}} ({{.Bytes}} bytes)</td></tr>
+<tr><th>bodyhash</th><td>{{.BodyHash}}</td></tr>
+</table>
+<h3>Headers</h3>
+<table border="1" cellpadding="3">
+{{range .Headers}}<tr><th align="left">{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+<h3>Parts</h3>
+{{range .Parts}}<p>{{.Path}}: {{.ContentType}}{{if .Filename}} '{{.Filename}}'{{end}}, {{.Size}} bytes</p>
+{{if .Text}}<pre>{{.Text}}</pre>{{end}}
+{{end}}
+</body></html>
+`))